@@ -4,12 +4,17 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/raine/telegram-tori-bot/tori"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/exp/slices"
 )
@@ -25,13 +30,26 @@ type Bot struct {
 	state          BotState
 	toriApiBaseUrl string
 	userConfigMap  UserConfigMap
+	// sendRetryDelay is how long to wait before retrying a step of sending a
+	// listing that failed. Zero disables retrying.
+	sendRetryDelay time.Duration
+	// listingStore keeps listings in progress over restarts, if configured
+	listingStore *ListingStore
+	// dryRun makes sending a listing log the payload instead of posting it
+	dryRun bool
+	// toriRetryWaitTime is the longest wait between retries of requests to
+	// tori. Zero uses tori client's default.
+	toriRetryWaitTime time.Duration
 }
 
+const defaultSendRetryDelay = 2 * time.Second
+
 func NewBot(tg BotAPI, userConfigMap UserConfigMap, toriApiBaseUrl string) *Bot {
 	bot := &Bot{
 		tg:             tg,
 		userConfigMap:  userConfigMap,
 		toriApiBaseUrl: toriApiBaseUrl,
+		sendRetryDelay: defaultSendRetryDelay,
 	}
 
 	bot.state = bot.NewBotState()
@@ -64,6 +82,16 @@ func (b *Bot) handlePhoto(message *tgbotapi.Message) {
 				time.Sleep(1 * time.Second)
 			}
 
+			// The photos are added while no update is being handled, so that
+			// the session is not changed or saved concurrently
+			session.mu.Lock()
+			defer session.mu.Unlock()
+
+			// Photos were removed or the listing was reset while waiting
+			if session.pendingPhotos == nil {
+				return
+			}
+
 			// Order pending photos batch based on message id, which is the
 			// order in which message were sent, but not necessary the order
 			// they are processed by the program
@@ -71,13 +99,28 @@ func (b *Bot) handlePhoto(message *tgbotapi.Message) {
 				return a.messageId < b.messageId
 			})
 
+			newPhotos := make([]tgbotapi.PhotoSize, 0, len(*session.pendingPhotos))
 			for _, pendingPhoto := range *session.pendingPhotos {
-				session.photos = append(session.photos, pendingPhoto.photoSize)
+				newPhotos = append(newPhotos, pendingPhoto.photoSize)
+			}
+			if session.photoHashes == nil {
+				session.photoHashes = make(map[string]string)
 			}
+			for id, hash := range hashPhotos(session.logger(), b.tg.GetFileDirectURL, newPhotos) {
+				session.photoHashes[id] = hash
+			}
+			var skipped int
+			session.photos, skipped = appendUniquePhotos(session.photos, newPhotos, session.photoHashes)
 
-			session.reply("%s lisätty", pluralize("kuva", "kuvaa", len(*session.pendingPhotos)))
+			added := pluralize("kuva", "kuvaa", len(newPhotos)-skipped)
+			if skipped > 0 {
+				session.reply(photosAddedWithDuplicatesText, added, skipped)
+			} else {
+				session.reply("%s lisätty", added)
+			}
 			session.pendingPhotos = nil
-			log.Info().Interface("photos", session.photos).Msg("added pending photos to session")
+			session.saveListing()
+			session.logger().Info().Interface("photos", session.photos).Msg("added pending photos to session")
 		}()
 	}
 
@@ -85,11 +128,11 @@ func (b *Bot) handlePhoto(message *tgbotapi.Message) {
 	largestPhoto := message.Photo[len(message.Photo)-1]
 	url, err := b.tg.GetFileDirectURL(largestPhoto.FileID)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to get photo url")
+		session.logger().Error().Err(err).Msg("failed to get photo url")
 		return
 	}
 
-	log.Info().Interface("photo", largestPhoto).Str("url", url).Int("messageId", message.MessageID).Msg("added photo to pending photos")
+	session.logger().Info().Interface("photo", largestPhoto).Str("url", url).Int("messageId", message.MessageID).Msg("added photo to pending photos")
 	pendingPhoto := PendingPhoto{
 		messageId: message.MessageID,
 		photoSize: largestPhoto,
@@ -112,6 +155,24 @@ func (b *Bot) handleCallback(update tgbotapi.Update) {
 
 	session.mu.Lock()
 	defer session.mu.Unlock()
+	defer session.saveListing()
+
+	if strings.HasPrefix(update.CallbackQuery.Data, photosCallbackPrefix) {
+		b.handlePhotosCallback(session, update)
+		return
+	}
+	if strings.HasPrefix(update.CallbackQuery.Data, browseCallbackPrefix) {
+		b.handleBrowseCallback(session, update)
+		return
+	}
+	if strings.HasPrefix(update.CallbackQuery.Data, cancelCallbackPrefix) {
+		b.handleCancelCallback(session, update)
+		return
+	}
+	if strings.HasPrefix(update.CallbackQuery.Data, categoryCallbackPrefix) {
+		b.handleCategorySearchCallback(session, update)
+		return
+	}
 
 	var newCategoryCode string
 	for _, c := range session.categories {
@@ -127,9 +188,10 @@ func (b *Bot) handleCallback(update tgbotapi.Update) {
 	}
 	missingFieldBefore := getMissingListingField(newadFilters.Newad.ParamMap, newadFilters.Newad.SettingsParams, *session.listing)
 
+	// Answers to fields that are asked in the new category too are kept
+	previousAdDetails := session.listing.AdDetails
 	session.listing.Category = newCategoryCode
-	// Clear the AdDetails, since category has changed
-	session.listing.AdDetails = nil
+	session.listing.AdDetails = restoreAdDetails(newadFilters.Newad.ParamMap, newadFilters.Newad.SettingsParams, *session.listing, previousAdDetails)
 	msg := makeCategoryMessage(session.categories, newCategoryCode)
 	msgReplyMarkup, _ := msg.ReplyMarkup.(tgbotapi.InlineKeyboardMarkup)
 	editMsg := tgbotapi.NewEditMessageTextAndMarkup(
@@ -158,12 +220,48 @@ func (b *Bot) handleCallback(update tgbotapi.Update) {
 		return
 	}
 	// Reduce a bit of noise by not sending the prompt message if it's the same
-	// as previous one, before changing category
-	if missingFieldBefore != missingFieldNow {
+	// as previous one, before changing category. When category was not
+	// confirmed yet, no field has been asked before.
+	if missingFieldBefore != missingFieldNow || session.categoryUnconfirmed {
+		session.categoryUnconfirmed = false
 		session.replyWithMessage(msg)
 	}
 }
 
+// selectCategoryByNumber selects a category by its number in the category
+// message, for clients where the inline keyboard can't be used. Reports
+// whether text was the number of a category.
+func (b *Bot) selectCategoryByNumber(session *UserSession, text string) bool {
+	n, err := strconv.Atoi(strings.TrimSpace(text))
+	if err != nil || n < 1 || n > len(session.categories) {
+		return false
+	}
+
+	category := session.categories[n-1]
+	if err := setListingCategory(session, category.Code); err != nil {
+		session.replyWithError(err)
+		return true
+	}
+	session.categoryUnconfirmed = false
+	session.reply("*Osasto:* %s", category.Label)
+
+	msg, missingField, err := makeNextFieldPrompt(session.client.GetFiltersSectionNewad, *session.listing)
+	if err != nil {
+		session.replyWithError(err)
+		return true
+	}
+	if missingField != "" {
+		session.replyWithMessage(msg)
+	}
+	return true
+}
+
+// isReplyToMessage reports whether message is a reply to the message with
+// messageId
+func isReplyToMessage(message *tgbotapi.Message, messageId int) bool {
+	return messageId != 0 && message.ReplyToMessage != nil && message.ReplyToMessage.MessageID == messageId
+}
+
 func (b *Bot) handleFreetextReply(update tgbotapi.Update) {
 	var text string
 	if update.Message.Caption != "" {
@@ -198,9 +296,9 @@ func (b *Bot) handleFreetextReply(update tgbotapi.Update) {
 			return
 		}
 
-		listing := newListingFromMessage(text)
+		listing := newListingFromMessage(text, session.defaultListingType())
 		session.userSubjectMessageId = update.Message.MessageID
-		session.listing = &listing
+		session.startListing(&listing)
 		// Remove custom keyboard just in case there was one from previous
 		// listing creation that did not finish
 		sent := session.reply(listingSubjectIsText, session.listing.Subject)
@@ -211,7 +309,7 @@ func (b *Bot) handleFreetextReply(update tgbotapi.Update) {
 			session.reset()
 			return
 		}
-		log.Info().Str("subject", session.listing.Subject).Interface("categories", categories).Msg("found categories for subject")
+		session.logger().Info().Str("subject", session.listing.Subject).Interface("categories", categories).Msg("found categories for subject")
 		if len(categories) == 0 {
 			// TODO: add fallback mechanism for selecting category
 			session.reply(cantFigureOutCategoryText)
@@ -220,9 +318,20 @@ func (b *Bot) handleFreetextReply(update tgbotapi.Update) {
 		}
 		session.categories = categories
 		session.listing.Category = categories[0].Code
+		session.logger().Info().Interface("listing", session.listing).Msg("started a new listing")
+
+		// In confirm mode, the guessed category must be confirmed before
+		// asking the other fields
+		if session.confirmCategory {
+			session.categoryUnconfirmed = true
+			sent := session.replyWithMessage(makeCategoryConfirmMessage(categories, session.listing.Category))
+			session.botCategoryMessageId = sent.MessageID
+			return
+		}
+
 		msg := makeCategoryMessage(categories, session.listing.Category)
-		session.replyWithMessage(msg)
-		log.Info().Interface("listing", session.listing).Msg("started a new listing")
+		sent = session.replyWithMessage(msg)
+		session.botCategoryMessageId = sent.MessageID
 
 		msg, _, err = makeNextFieldPrompt(session.client.GetFiltersSectionNewad, *session.listing)
 		if err != nil {
@@ -230,6 +339,15 @@ func (b *Bot) handleFreetextReply(update tgbotapi.Update) {
 			return
 		}
 		session.replyWithMessage(msg)
+	} else if session.categoryUnconfirmed {
+		if !b.selectCategoryByNumber(session, text) {
+			session.reply(confirmCategoryFirstText)
+		}
+	} else if isReplyToMessage(update.Message, session.botCategoryMessageId) {
+		// Otherwise a number could be an answer to the next field, e.g. price
+		if !b.selectCategoryByNumber(session, text) {
+			session.reply(invalidCategoryNumberText, text)
+		}
 	} else {
 		// Augment a previously started listing with user's message
 		newadFilters, err := fetchNewadFilters(session.client.GetFiltersSectionNewad)
@@ -244,11 +362,11 @@ func (b *Bot) handleFreetextReply(update tgbotapi.Update) {
 		// getting the next missing field from Listing
 		repliedField := getMissingListingField(paramMap, settingsParams, *session.listing)
 		if repliedField == "" {
-			log.Info().Msg("not expecting a reply")
+			session.logger().Info().Msg("not expecting a reply")
 			return
 		}
 
-		log.Info().Str("field", repliedField).Msg("user is replying to field")
+		session.logger().Info().Str("field", repliedField).Msg("user is replying to field")
 		newListing, err := setListingFieldFromMessage(paramMap, *session.listing, repliedField, text)
 		if err != nil {
 			var noLabelFoundError *NoLabelFoundError
@@ -262,12 +380,22 @@ func (b *Bot) handleFreetextReply(update tgbotapi.Update) {
 			return
 		}
 		session.listing = &newListing
-		log.Info().Interface("listing", newListing).Msg("updated listing")
+		session.logger().Info().Interface("listing", newListing).Msg("updated listing")
+
+		// Tell which value was selected, if the reply had a typo in it
+		param := paramMap[repliedField]
+		if param.SingleSelection != nil {
+			valueLabel := getLabelForParamValue(param, newListing.AdDetails[param.SingleSelection.ParamKey])
+			if valueLabel != "" && !strings.EqualFold(valueLabel, strings.TrimSpace(text)) {
+				session.reply("*%s:* %s", param.SingleSelection.Label, valueLabel)
+			}
+		}
 
 		if repliedField == "body" {
 			session.userBodyMessageId = update.Message.MessageID
 			sent := session.reply(listingBodyIsText, session.listing.Body)
 			session.botBodyMessageId = sent.MessageID
+			warnAboutDescriptionQuality(session)
 		}
 
 		msg, missingField, err := makeNextFieldPrompt(session.client.GetFiltersSectionNewad, *session.listing)
@@ -304,17 +432,59 @@ func (b *Bot) sendListingCommand(update tgbotapi.Update) {
 		return
 	}
 
+	if missing := session.minPhotos - len(session.photos); missing > 0 {
+		session.logger().Info().Int("minPhotos", session.minPhotos).Int("photos", len(session.photos)).Msg("cannot send listing with too few photos")
+		session.reply(notEnoughPhotosOnSendText, pluralize("kuva", "kuvaa", missing))
+		return
+	}
+
+	if session.categoryUnconfirmed {
+		session.reply(confirmCategoryFirstText)
+		return
+	}
+
 	_, missingField, err := makeNextFieldPrompt(session.client.GetFiltersSectionNewad, *session.listing)
 	if err != nil {
-		log.Error().Stack().Err(err).Send()
+		session.logger().Error().Stack().Err(err).Send()
 		return
 	}
 	if missingField != "" {
-		log.Info().Str("missingField", missingField).Msg("cannot send listing with missing field(s)")
+		session.logger().Info().Str("missingField", missingField).Msg("cannot send listing with missing field(s)")
 		session.reply(incompleteListingOnSendText)
 		return
 	}
 
+	// Subject is shown everywhere, so it's not truncated without asking like
+	// the body is
+	if n := utf8.RuneCountInString(session.listing.Subject); n > tori.MaxSubjectLength {
+		session.reply(subjectTooLongText, n, tori.MaxSubjectLength)
+		return
+	}
+	if utf8.RuneCountInString(session.listing.Body) > tori.MaxBodyLength {
+		session.listing.Body = truncateAtWordBoundary(session.listing.Body, tori.MaxBodyLength)
+		session.reply(bodyTruncatedText, tori.MaxBodyLength)
+	}
+	// Body may have been set in a way that was not checked yet, e.g. with
+	// /tuojson before the check was turned on
+	warnAboutDescriptionQuality(session)
+
+	// Tori rejects listings with more images than the category allows, so
+	// leave out the last ones instead of failing to send. Session's photos
+	// are kept as they are, in case sending fails and the listing is e.g.
+	// moved to another category.
+	categories, err := fetchCategories(session.client.GetCategories)
+	if err != nil {
+		session.replyWithError(err)
+		return
+	}
+	photos := session.photos
+	maxImages := getMaxImagesForCategory(categories, session.listing.Category)
+	if len(photos) > maxImages {
+		session.logger().Info().Int("maxImages", maxImages).Int("photos", len(photos)).Msg("too many photos for category")
+		photos = photos[:maxImages]
+		session.reply(tooManyPhotosText, pluralize("kuva", "kuvaa", maxImages))
+	}
+
 	// Add location to listing based on logged in user's location
 	account, err := session.client.GetAccount(session.toriAccountId)
 	if err != nil {
@@ -325,12 +495,20 @@ func (b *Bot) sendListingCommand(update tgbotapi.Update) {
 	session.listing.Location = &listingLocation
 	session.listing.AccountId = tori.ParseAccountIdNumberFromPath(account.AccountId)
 
-	// Phone number hidden implicitly
-	session.listing.PhoneHidden = true
+	// Phone number is hidden unless user has opted in to show it
+	session.listing.PhoneHidden = !session.showPhone
 
-	medias, err := uploadListingPhotos(b.tg.GetFileDirectURL, session.client.UploadMedia, session.photos)
+	medias, err := uploadListingPhotos(session.logger(), b.sendRetryDelay, b.tg.GetFileDirectURL, session.client.UploadMedia, photos)
 	if err != nil {
-		session.replyWithError(err)
+		// Listing is not sent with some of the photos missing, so that user
+		// can retry instead of ending up with an incomplete listing
+		var photoUploadError *PhotoUploadError
+		if errors.As(err, &photoUploadError) {
+			failedCount := len(photoUploadError.Failed)
+			session.reply(photoUploadFailedText, photoUploadError.Total-failedCount, photoUploadError.Total, failedCount)
+		} else {
+			session.replyWithError(err)
+		}
 		return
 	}
 
@@ -342,7 +520,25 @@ func (b *Bot) sendListingCommand(update tgbotapi.Update) {
 	}
 	session.listing.Images = &listingImages
 
-	err = session.client.PostListing(*session.listing)
+	// In dry run mode, the listing is kept so that it can be sent again, e.g.
+	// after fixing whatever was being debugged
+	if b.dryRun {
+		payload, err := json.Marshal(session.listing)
+		if err != nil {
+			session.replyWithError(err)
+			return
+		}
+		session.logger().Info().RawJSON("payload", payload).Msg("dry run, skipping posting listing")
+		session.reply(listingDryRunText)
+		return
+	}
+
+	// Account is fetched and photos are uploaded again on errors that are
+	// likely temporary, but posting the listing is retried only if tori was
+	// not reached, so that the listing is not posted twice
+	err = retryOnError(session.logger(), b.sendRetryDelay, isConnectionError, func() error {
+		return session.client.PostListing(*session.listing)
+	})
 	if err != nil {
 		session.replyWithError(err)
 		return
@@ -351,7 +547,7 @@ func (b *Bot) sendListingCommand(update tgbotapi.Update) {
 
 	// Create a JSON archive of listing and photos. The archive can be used
 	// later to resend the same listing, perhaps with minor modifications.
-	archive := NewListingArchive(*session.listing, session.photos)
+	archive := NewListingArchive(*session.listing, photos)
 	archiveBytes, err := json.Marshal(archive)
 	if err != nil {
 		session.replyWithError(err)
@@ -369,10 +565,68 @@ func (b *Bot) sendListingCommand(update tgbotapi.Update) {
 		return
 	}
 
-	log.Info().Interface("listing", session.listing).Msg("listing posted successfully")
+	session.logger().Info().Interface("listing", session.listing).Msg("listing posted successfully")
 	session.reset()
 }
 
+// handleCheckListing reports which of the checks for sending a listing pass,
+// without sending it
+func (b *Bot) handleCheckListing(update tgbotapi.Update) {
+	userId := update.Message.From.ID
+	session, err := b.state.getUserSession(userId)
+	if err != nil {
+		log.Error().Err(err).Send()
+		return
+	}
+
+	if session.listing == nil {
+		session.reply(noListingOnCheckText)
+		return
+	}
+
+	newadFilters, err := fetchNewadFilters(session.client.GetFiltersSectionNewad)
+	if err != nil {
+		session.replyWithError(err)
+		return
+	}
+
+	categories, err := fetchCategories(session.client.GetCategories)
+	if err != nil {
+		session.replyWithError(err)
+		return
+	}
+
+	checks := validateListing(
+		newadFilters.Newad.ParamMap,
+		newadFilters.Newad.SettingsParams,
+		categories,
+		*session.listing,
+		session.categoryUnconfirmed,
+		len(session.photos),
+		session.minPhotos,
+	)
+
+	// Location of the listing is taken from tori account when sending
+	account, err := session.client.GetAccount(session.toriAccountId)
+	checks = append(checks, listingCheck{
+		label: "Tilin paikkakunta",
+		ok:    err == nil && len(account.Locations) > 0,
+	})
+
+	text := fmt.Sprintf(listingChecksText, formatListingChecks(checks))
+	if allListingChecksOk(checks) {
+		text = fmt.Sprintf("%s\n\n%s", text, listingReadyToBeSentText)
+	}
+
+	// Photos are shown in the order they will be in the listing, to catch a
+	// wrong photo or main photo before sending
+	if err := b.sendPhotos(session); err != nil {
+		session.replyWithError(err)
+		return
+	}
+	session.reply(text)
+}
+
 func (b *Bot) handleImportJson(update tgbotapi.Update) {
 	userId := update.Message.From.ID
 	session, err := b.state.getUserSession(userId)
@@ -387,7 +641,7 @@ func (b *Bot) handleImportJson(update tgbotapi.Update) {
 		return
 	}
 
-	archiveBytes, err := downloadFileID(b.tg.GetFileDirectURL, replyToMessage.Document.FileID)
+	archiveBytes, err := downloadFileID(session.logger(), b.tg.GetFileDirectURL, replyToMessage.Document.FileID)
 	if err != nil {
 		session.replyWithError(err)
 		return
@@ -402,7 +656,7 @@ func (b *Bot) handleImportJson(update tgbotapi.Update) {
 	}
 
 	session.photos = archive.Photos
-	session.listing = &archive.Listing
+	session.startListing(&archive.Listing)
 
 	// When the listing is marshalled for the json archive, empty
 	// delivery_options won't exist in the output json. This is because in the
@@ -416,6 +670,7 @@ func (b *Bot) handleImportJson(update tgbotapi.Update) {
 	}
 
 	session.reply(importJsonSuccessful, session.listing.Subject)
+	warnAboutDescriptionQuality(session)
 }
 
 func (b *Bot) handleForget(update tgbotapi.Update, args []string) {
@@ -445,6 +700,566 @@ func (b *Bot) handleForget(update tgbotapi.Update, args []string) {
 	session.replyWithMessage(msg)
 }
 
+func (b *Bot) handleAddCategoryAlias(update tgbotapi.Update, args []string) {
+	userId := update.Message.From.ID
+	session, err := b.state.getUserSession(userId)
+	if err != nil {
+		log.Error().Err(err).Send()
+		return
+	}
+
+	if len(args) != 2 {
+		session.reply(addCategoryAliasUsageText)
+		return
+	}
+	alias, code := strings.ToLower(args[0]), args[1]
+
+	categories, err := fetchCategories(session.client.GetCategories)
+	if err != nil {
+		session.replyWithError(err)
+		return
+	}
+
+	// Listings can only be added to leaf categories, so aliases to parent
+	// categories would be of no use
+	category, ok := categories.FindCategory(code)
+	if !ok || !category.IsLeaf() {
+		session.reply(invalidCategoryAliasCodeText, code)
+		return
+	}
+
+	if session.categoryAliases == nil {
+		session.categoryAliases = make(map[string]tori.Category)
+	}
+	session.categoryAliases[alias] = category
+	session.logger().Info().Str("alias", alias).Interface("category", category).Msg("added category alias")
+	session.reply(categoryAliasAddedText, alias, category.Label)
+}
+
+func (b *Bot) handleCategoryCommand(update tgbotapi.Update, args []string) {
+	userId := update.Message.From.ID
+	session, err := b.state.getUserSession(userId)
+	if err != nil {
+		log.Error().Err(err).Send()
+		return
+	}
+
+	if len(args) > 1 {
+		session.reply(categoryCommandUsageText)
+		return
+	}
+
+	if session.listing == nil {
+		session.reply(noListingOnCategoryText)
+		return
+	}
+
+	// Without alias, user can browse the whole category tree
+	if len(args) == 0 {
+		categories, err := fetchCategories(session.client.GetCategories)
+		if err != nil {
+			session.replyWithError(err)
+			return
+		}
+		session.replyWithMessage(makeCategoryBrowseMessage(nil, categories.Categories, ""))
+		return
+	}
+
+	category, ok := session.categoryAliases[strings.ToLower(args[0])]
+	if !ok {
+		session.reply(unknownCategoryAliasText, args[0])
+		return
+	}
+
+	if err := setListingCategory(session, category.Code); err != nil {
+		session.replyWithError(err)
+		return
+	}
+	session.categoryUnconfirmed = false
+	session.reply("*Osasto:* %s", category.Label)
+
+	msg, missingField, err := makeNextFieldPrompt(session.client.GetFiltersSectionNewad, *session.listing)
+	if err != nil {
+		session.replyWithError(err)
+		return
+	}
+	if missingField != "" {
+		session.replyWithMessage(msg)
+	}
+}
+
+// handleSwitchListingType switches the listing between selling and giving
+// away. Giving away has no price, so price is asked again when switching
+// back to selling. Other listing types, e.g. buying, are not switched.
+func (b *Bot) handleSwitchListingType(update tgbotapi.Update) {
+	userId := update.Message.From.ID
+	session, err := b.state.getUserSession(userId)
+	if err != nil {
+		log.Error().Err(err).Send()
+		return
+	}
+
+	if session.listing == nil {
+		session.reply(noListingOnSwitchTypeText)
+		return
+	}
+
+	newadFilters, err := fetchNewadFilters(session.client.GetFiltersSectionNewad)
+	if err != nil {
+		session.replyWithError(err)
+		return
+	}
+
+	switch session.listing.Type {
+	case tori.ListingTypeGive:
+		session.listing.Type = tori.ListingTypeSell
+		session.reply(listingTypeSellText)
+	case tori.ListingTypeSell:
+		session.listing.Type = tori.ListingTypeGive
+		session.listing.Price = 0
+		session.reply(listingTypeGiveText)
+	default:
+		session.reply(listingTypeNotSwitchableText)
+		return
+	}
+	session.logger().Info().Interface("type", session.listing.Type).Msg("switched listing type")
+
+	// Fields that are asked depend on the type, so answers to fields that are
+	// not asked for the new type are dropped
+	session.listing.AdDetails = restoreAdDetails(
+		newadFilters.Newad.ParamMap,
+		newadFilters.Newad.SettingsParams,
+		*session.listing,
+		session.listing.AdDetails,
+	)
+
+	msg, missingField, err := makeNextFieldPrompt(session.client.GetFiltersSectionNewad, *session.listing)
+	if err != nil {
+		session.replyWithError(err)
+		return
+	}
+	if missingField != "" {
+		session.replyWithMessage(msg)
+	}
+}
+
+// handleBrowseCallback opens a category in the category tree sent by /osasto,
+// or selects it if it has no subcategories
+func (b *Bot) handleBrowseCallback(session *UserSession, update tgbotapi.Update) {
+	callback := tgbotapi.NewCallback(update.CallbackQuery.ID, "")
+	if _, err := b.tg.Request(callback); err != nil {
+		session.replyWithError(err)
+		return
+	}
+
+	if session.listing == nil {
+		session.reply(noListingOnCategoryText)
+		return
+	}
+
+	categories, err := fetchCategories(session.client.GetCategories)
+	if err != nil {
+		session.replyWithError(err)
+		return
+	}
+
+	var msg tgbotapi.MessageConfig
+	code := strings.TrimPrefix(update.CallbackQuery.Data, browseCallbackPrefix)
+	category, ok := categories.FindCategory(code)
+	switch {
+	case code == "" || !ok:
+		msg = makeCategoryBrowseMessage(nil, categories.Categories, "")
+	case category.IsLeaf():
+		msg = tgbotapi.NewMessage(0, fmt.Sprintf("*Osasto:* %s", category.Label))
+		msg.ParseMode = tgbotapi.ModeMarkdown
+	default:
+		parent, _ := categories.FindParent(code)
+		msg = makeCategoryBrowseMessage(&category, category.Categories, parent.Code)
+	}
+
+	var editMsg tgbotapi.EditMessageTextConfig
+	if msgReplyMarkup, ok := msg.ReplyMarkup.(tgbotapi.InlineKeyboardMarkup); ok {
+		editMsg = tgbotapi.NewEditMessageTextAndMarkup(
+			update.CallbackQuery.From.ID,
+			update.CallbackQuery.Message.MessageID,
+			msg.Text,
+			msgReplyMarkup,
+		)
+	} else {
+		editMsg = tgbotapi.NewEditMessageText(
+			update.CallbackQuery.From.ID,
+			update.CallbackQuery.Message.MessageID,
+			msg.Text,
+		)
+	}
+	editMsg.ParseMode = tgbotapi.ModeMarkdown
+	if _, err := b.tg.Send(editMsg); err != nil {
+		session.replyWithError(err)
+		return
+	}
+
+	if !ok || !category.IsLeaf() {
+		return
+	}
+
+	session.logger().Info().Str("category", category.Code).Msg("selected category from category tree")
+	b.selectCategory(session, category)
+}
+
+// handleCategorySearchCallback sets the category chosen from the results of
+// /etsiosasto
+func (b *Bot) handleCategorySearchCallback(session *UserSession, update tgbotapi.Update) {
+	callback := tgbotapi.NewCallback(update.CallbackQuery.ID, "")
+	if _, err := b.tg.Request(callback); err != nil {
+		session.replyWithError(err)
+		return
+	}
+
+	if session.listing == nil {
+		session.reply(noListingOnCategoryText)
+		return
+	}
+
+	categories, err := fetchCategories(session.client.GetCategories)
+	if err != nil {
+		session.replyWithError(err)
+		return
+	}
+
+	code := strings.TrimPrefix(update.CallbackQuery.Data, categoryCallbackPrefix)
+	category, ok := categories.FindCategory(code)
+	if !ok || !category.IsLeaf() {
+		session.logger().Warn().Str("category", code).Msg("selected category from search results does not exist")
+		return
+	}
+
+	editMsg := tgbotapi.NewEditMessageText(
+		update.CallbackQuery.From.ID,
+		update.CallbackQuery.Message.MessageID,
+		fmt.Sprintf("*Osasto:* %s", category.Label),
+	)
+	editMsg.ParseMode = tgbotapi.ModeMarkdown
+	if _, err := b.tg.Send(editMsg); err != nil {
+		session.replyWithError(err)
+		return
+	}
+
+	session.logger().Info().Str("category", category.Code).Msg("selected category from search results")
+	b.selectCategory(session, category)
+}
+
+// selectCategory sets the listing's category to a leaf category chosen with
+// buttons, and asks for the next missing field
+func (b *Bot) selectCategory(session *UserSession, category tori.Category) {
+	if err := setListingCategory(session, category.Code); err != nil {
+		session.replyWithError(err)
+		return
+	}
+	session.categoryUnconfirmed = false
+
+	msg, missingField, err := makeNextFieldPrompt(session.client.GetFiltersSectionNewad, *session.listing)
+	if err != nil {
+		session.replyWithError(err)
+		return
+	}
+	if missingField != "" {
+		session.replyWithMessage(msg)
+	}
+}
+
+// confirmCancelMinPhotos is the number of photos from which cancelling a
+// listing with /peru is confirmed first
+const confirmCancelMinPhotos = 5
+
+// handleCancelCommand cancels the listing in progress. Cancelling a listing
+// with many photos or one that is ready to be sent by accident is painful, so
+// it's confirmed first.
+func (b *Bot) handleCancelCommand(session *UserSession) {
+	if session.listing == nil {
+		b.cancelListing(session)
+		return
+	}
+
+	if len(session.photos) >= confirmCancelMinPhotos {
+		text := fmt.Sprintf(confirmCancelText, len(session.photos))
+		session.replyWithMessage(makeConfirmCancelMessage(text, session.listingId))
+		return
+	}
+
+	// The listing is cancelled without asking if it can't be checked, since
+	// the confirmation only guards against accidents
+	newadFilters, err := fetchNewadFilters(session.client.GetFiltersSectionNewad)
+	if err != nil {
+		session.logger().Error().Stack().Err(err).Msg("failed to check if cancelled listing is ready")
+	} else if getMissingListingField(newadFilters.Newad.ParamMap, newadFilters.Newad.SettingsParams, *session.listing) == "" {
+		session.replyWithMessage(makeConfirmCancelMessage(confirmCancelReadyText, session.listingId))
+		return
+	}
+	b.cancelListing(session)
+}
+
+func (b *Bot) cancelListing(session *UserSession) {
+	if session.cancelListing() {
+		session.replyAndRemoveCustomKeyboard(listingCancelledText)
+	} else {
+		session.replyAndRemoveCustomKeyboard(okText)
+	}
+}
+
+// handleCancelCallback cancels the listing or keeps it, based on the button
+// pressed in the message sent by /peru
+func (b *Bot) handleCancelCallback(session *UserSession, update tgbotapi.Update) {
+	callback := tgbotapi.NewCallback(update.CallbackQuery.ID, "")
+	if _, err := b.tg.Request(callback); err != nil {
+		session.replyWithError(err)
+		return
+	}
+
+	// The question is removed so that it can't be answered twice
+	deleteMsg := tgbotapi.NewDeleteMessage(update.CallbackQuery.From.ID, update.CallbackQuery.Message.MessageID)
+	if _, err := b.tg.Request(deleteMsg); err != nil {
+		session.replyWithError(err)
+		return
+	}
+
+	// The listing asked about may have been sent or cancelled already
+	answer, listingId, _ := strings.Cut(strings.TrimPrefix(update.CallbackQuery.Data, cancelCallbackPrefix), ":")
+	if session.listing == nil || listingId != session.listingId {
+		session.logger().Info().Str("callbackListingId", listingId).Msg("ignoring cancel confirmation of another listing")
+		return
+	}
+
+	if answer == "yes" {
+		b.cancelListing(session)
+	} else {
+		session.reply(listingNotCancelledText)
+	}
+}
+
+// handlePhotosCommand shows listing's photos in order, with buttons to delete
+// them or change the first one
+func (b *Bot) handlePhotosCommand(update tgbotapi.Update) {
+	userId := update.Message.From.ID
+	session, err := b.state.getUserSession(userId)
+	if err != nil {
+		log.Error().Err(err).Send()
+		return
+	}
+
+	if err := b.sendPhotos(session); err != nil {
+		session.replyWithError(err)
+		return
+	}
+	session.replyWithMessage(makePhotosMessage(session.photos))
+}
+
+// sendPhotos sends listing's photos back to user numbered and in order, so
+// that user can tell which photo is which. An album can have between 2 and
+// 10 photos.
+func (b *Bot) sendPhotos(session *UserSession) error {
+	for i := 0; i < len(session.photos); i += 10 {
+		chunk := session.photos[i:minInt(i+10, len(session.photos))]
+		var err error
+		if len(chunk) == 1 {
+			photo := tgbotapi.NewPhoto(session.userId, tgbotapi.FileID(chunk[0].FileID))
+			photo.Caption = fmt.Sprint(i + 1)
+			_, err = b.tg.Send(photo)
+		} else {
+			files := make([]interface{}, 0, len(chunk))
+			for j, p := range chunk {
+				media := tgbotapi.NewInputMediaPhoto(tgbotapi.FileID(p.FileID))
+				media.Caption = fmt.Sprint(i + j + 1)
+				files = append(files, media)
+			}
+			_, err = b.tg.Request(tgbotapi.NewMediaGroup(session.userId, files))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handlePhotosCallback deletes a photo or moves it first, based on the
+// button pressed in the message sent by handlePhotosCommand
+func (b *Bot) handlePhotosCallback(session *UserSession, update tgbotapi.Update) {
+	data := strings.TrimPrefix(update.CallbackQuery.Data, photosCallbackPrefix)
+	action, fileUniqueId, _ := strings.Cut(data, ":")
+	index := slices.IndexFunc(session.photos, func(p tgbotapi.PhotoSize) bool {
+		return p.FileUniqueID == fileUniqueId
+	})
+
+	// The photo may have been deleted already, with a button in another
+	// message or with /poistakuvat
+	callback := tgbotapi.NewCallback(update.CallbackQuery.ID, "")
+	if index == -1 {
+		callback.Text = photoNotFoundText
+	}
+	if _, err := b.tg.Request(callback); err != nil {
+		session.replyWithError(err)
+		return
+	}
+	if index == -1 {
+		return
+	}
+
+	switch action {
+	case "delete":
+		session.photos = slices.Delete(session.photos, index, index+1)
+	case "cover":
+		photo := session.photos[index]
+		session.photos = slices.Insert(slices.Delete(session.photos, index, index+1), 0, photo)
+	}
+	session.logger().Info().Str("action", action).Str("fileUniqueId", fileUniqueId).Int("photos", len(session.photos)).Msg("changed photos")
+
+	// Numbers of the photos change, so the photos are sent again with new
+	// numbers and the old buttons are removed
+	deleteMsg := tgbotapi.NewDeleteMessage(update.CallbackQuery.From.ID, update.CallbackQuery.Message.MessageID)
+	if _, err := b.tg.Request(deleteMsg); err != nil {
+		session.replyWithError(err)
+		return
+	}
+	if err := b.sendPhotos(session); err != nil {
+		session.replyWithError(err)
+		return
+	}
+	session.replyWithMessage(makePhotosMessage(session.photos))
+}
+
+// maxCategorySearchResults is how many categories are offered at most when
+// searching categories with keywords
+const maxCategorySearchResults = 8
+
+// handleSearchCategoryCommand searches categories by keywords and offers
+// them for selection with an inline keyboard
+func (b *Bot) handleSearchCategoryCommand(update tgbotapi.Update, args []string) {
+	userId := update.Message.From.ID
+	session, err := b.state.getUserSession(userId)
+	if err != nil {
+		log.Error().Err(err).Send()
+		return
+	}
+
+	if len(args) == 0 {
+		session.reply(searchCategoryUsageText)
+		return
+	}
+
+	if session.listing == nil {
+		session.reply(noListingOnCategoryText)
+		return
+	}
+
+	keywords := strings.Join(args, " ")
+	categories, err := fetchCategories(session.client.GetCategories)
+	if err != nil {
+		session.replyWithError(err)
+		return
+	}
+	results := categories.SearchLeafCategories(keywords)
+	if len(results) == 0 {
+		session.reply(noCategoriesFoundText, keywords)
+		return
+	}
+	if len(results) > maxCategorySearchResults {
+		results = results[:maxCategorySearchResults]
+	}
+
+	// Selecting a category is handled in handleCategorySearchCallback
+	session.replyWithMessage(makeCategorySearchResultsMessage(categories, results))
+}
+
+// handleExportSettings sends user's settings as a JSON file, that can be
+// imported later with /tuoasetukset
+func (b *Bot) handleExportSettings(update tgbotapi.Update) {
+	userId := update.Message.From.ID
+	session, err := b.state.getUserSession(userId)
+	if err != nil {
+		log.Error().Err(err).Send()
+		return
+	}
+
+	settingsBytes, err := json.Marshal(session.exportSettings())
+	if err != nil {
+		session.replyWithError(err)
+		return
+	}
+	document := tgbotapi.NewDocument(session.userId, tgbotapi.FileBytes{
+		Name:  "settings.json",
+		Bytes: settingsBytes,
+	})
+	document.Caption = settingsExportCaption
+
+	_, err = b.tg.Send(document)
+	if err != nil {
+		session.replyWithError(err)
+		return
+	}
+}
+
+func (b *Bot) handleImportSettings(update tgbotapi.Update) {
+	userId := update.Message.From.ID
+	session, err := b.state.getUserSession(userId)
+	if err != nil {
+		log.Error().Err(err).Send()
+		return
+	}
+
+	replyToMessage := update.Message.ReplyToMessage
+	if replyToMessage == nil || replyToMessage.Document == nil || replyToMessage.Document.MimeType != "application/json" {
+		session.reply(importSettingsInputError)
+		return
+	}
+
+	settingsBytes, err := downloadFileID(session.logger(), b.tg.GetFileDirectURL, replyToMessage.Document.FileID)
+	if err != nil {
+		session.replyWithError(err)
+		return
+	}
+
+	var settings UserSettings
+	if err := json.Unmarshal(settingsBytes, &settings); err != nil {
+		session.replyWithError(err)
+		return
+	}
+
+	categories, err := fetchCategories(session.client.GetCategories)
+	if err != nil {
+		session.replyWithError(err)
+		return
+	}
+
+	rejectedAliases := session.importSettings(settings, categories)
+	session.logger().Info().
+		Interface("settings", settings).
+		Strs("rejectedAliases", rejectedAliases).
+		Msg("imported settings")
+	session.reply(importSettingsSuccessful)
+	if len(rejectedAliases) > 0 {
+		session.reply(importSettingsRejectedAliasesText, strings.Join(rejectedAliases, ", "))
+	}
+}
+
+func (b *Bot) handleRestoreCancelledListing(update tgbotapi.Update) {
+	userId := update.Message.From.ID
+	session, err := b.state.getUserSession(userId)
+	if err != nil {
+		log.Error().Err(err).Send()
+		return
+	}
+
+	if session.listing != nil {
+		session.reply(listingInProgressOnRestoreText)
+		return
+	}
+
+	if !session.restoreCancelledListing() {
+		session.reply(noCancelledListingText)
+		return
+	}
+	session.reply(cancelledListingRestoredText, session.listing.Subject)
+}
+
 func (b *Bot) handleMessageEdit(update tgbotapi.Update) {
 	userId := update.EditedMessage.From.ID
 	session, err := b.state.getUserSession(userId)
@@ -453,9 +1268,13 @@ func (b *Bot) handleMessageEdit(update tgbotapi.Update) {
 		return
 	}
 
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
 	if session.listing == nil {
 		return
 	}
+	defer session.saveListing()
 
 	var text string
 	if update.EditedMessage.Caption != "" {
@@ -468,8 +1287,8 @@ func (b *Bot) handleMessageEdit(update tgbotapi.Update) {
 	switch update.EditedMessage.MessageID {
 	// User edited subject message with the intent of changing the subject
 	case session.userSubjectMessageId:
-		listing := newListingFromMessage(text)
-		log.Info().Str("oldSubject", session.listing.Subject).Str("newSubject", listing.Subject).Msg("listing subject updated")
+		listing := newListingFromMessage(text, session.listing.Type)
+		session.logger().Info().Str("oldSubject", session.listing.Subject).Str("newSubject", listing.Subject).Msg("listing subject updated")
 		session.listing.Subject = listing.Subject
 
 		editMsg = tgbotapi.NewEditMessageText(
@@ -479,7 +1298,7 @@ func (b *Bot) handleMessageEdit(update tgbotapi.Update) {
 		)
 	// User edited body message with the intent of changing the subject
 	case session.userBodyMessageId:
-		log.Info().Str("oldBody", session.listing.Body).Str("newBody", text).Msg("listing body updated")
+		session.logger().Info().Str("oldBody", session.listing.Body).Str("newBody", text).Msg("listing body updated")
 		session.listing.Body = strings.TrimSpace(text)
 
 		editMsg = tgbotapi.NewEditMessageText(
@@ -492,11 +1311,12 @@ func (b *Bot) handleMessageEdit(update tgbotapi.Update) {
 	if editMsg.ChatID != 0 {
 		editMsg.ParseMode = tgbotapi.ModeMarkdown
 		_, err = b.tg.Send(editMsg)
-		log.Info().Interface("editMsg", editMsg).Msg("message edited")
+		session.logger().Info().Interface("editMsg", editMsg).Msg("message edited")
 		if err != nil {
 			session.replyWithError(err)
 			return
 		}
+		warnAboutDescriptionQuality(session)
 	}
 }
 
@@ -525,27 +1345,58 @@ func (b *Bot) handleUpdate(update tgbotapi.Update) {
 
 	session.mu.Lock()
 	defer session.mu.Unlock()
+	defer session.saveListing()
 
-	log.Info().Str("text", update.Message.Text).Str("caption", update.Message.Caption).Msg("got message")
+	session.logger().Info().Str("text", update.Message.Text).Str("caption", update.Message.Caption).Msg("got message")
 	command, args := parseCommand(update.Message.Text)
+	if strings.HasPrefix(command, "/") {
+		if resolved := resolveCommand(command, session.commandAliases); resolved != "" {
+			command = resolved
+		} else if suggestion := suggestCommand(command); suggestion != "" {
+			session.reply(unknownCommandSuggestionText, suggestion)
+			return
+		}
+	}
+
 	switch command {
 	// /start is the command telegram client prompts user to send to a
 	// bot when there are no prior messages
 	case "/start":
 		session.reply(startText)
+	case "/ohje":
+		// Sent without markdown, because command names have underscores and
+		// dashes that could be taken as formatting
+		session.replyWithMessage(tgbotapi.NewMessage(0, makeHelpText(session.listing != nil)))
 	case "/peru":
-		session.reset()
-		session.replyAndRemoveCustomKeyboard(okText)
+		b.handleCancelCommand(session)
+	case "/perista":
+		b.handleRestoreCancelledListing(update)
 	case "/laheta":
 		b.sendListingCommand(update)
+	case "/tarkista":
+		b.handleCheckListing(update)
 	case "/poistakuvat":
 		session.photos = nil
 		session.pendingPhotos = nil
 		session.reply(photosRemoved)
+	case "/vaihda":
+		b.handleSwitchListingType(update)
+	case "/kuvat":
+		b.handlePhotosCommand(update)
 	case "/tuojson":
 		b.handleImportJson(update)
 	case "/unohda":
 		b.handleForget(update, args)
+	case "/lisaa-alias":
+		b.handleAddCategoryAlias(update, args)
+	case "/osasto":
+		b.handleCategoryCommand(update, args)
+	case "/etsiosasto":
+		b.handleSearchCategoryCommand(update, args)
+	case "/varmuuskopio":
+		b.handleExportSettings(update)
+	case "/tuoasetukset":
+		b.handleImportSettings(update)
 	default:
 		b.handleFreetextReply(update)
 	}
@@ -578,6 +1429,42 @@ func makeNextFieldPrompt(
 	return msg, missingField, nil
 }
 
+// retryOnError calls fn once more after delay if it failed with an error
+// that retryable accepts. Each step of sending a listing is retried
+// separately, so steps that already succeeded are not repeated.
+func retryOnError(logger *zerolog.Logger, delay time.Duration, retryable func(err error) bool, fn func() error) error {
+	err := fn()
+	if err == nil || delay == 0 || !retryable(err) {
+		return err
+	}
+
+	logger.Warn().Err(err).Dur("delay", delay).Msg("retrying after error")
+	time.Sleep(delay)
+	return fn()
+}
+
+// isConnectionError reports whether the connection to tori API could not be
+// opened. Then the request never reached tori, so making it again can't e.g.
+// post the same listing twice. Error responses, even gateway errors, may come
+// after the request was processed anyway.
+func isConnectionError(err error) bool {
+	var opError *net.OpError
+	return errors.As(err, &opError) && opError.Op == "dial"
+}
+
+// isTransientError reports whether a request failed with an error after which
+// it can succeed when made again, i.e. a network error, rate limiting or a
+// server error. Only requests that are safe to repeat should be retried on
+// these.
+func isTransientError(err error) bool {
+	var responseError *tori.ResponseError
+	if errors.As(err, &responseError) {
+		return responseError.StatusCode == http.StatusTooManyRequests || responseError.StatusCode >= http.StatusInternalServerError
+	}
+	var netError net.Error
+	return errors.As(err, &netError)
+}
+
 func fetchNewadFilters(get func() (tori.NewadFilters, error)) (tori.NewadFilters, error) {
 	cachedNewadFilters, ok := getCachedNewadFilters()
 	if !ok {
@@ -592,17 +1479,54 @@ func fetchNewadFilters(get func() (tori.NewadFilters, error)) (tori.NewadFilters
 	}
 }
 
+// setListingCategory changes listing's category, keeping the answers to
+// fields that are asked in the new category too
+func setListingCategory(session *UserSession, code string) error {
+	newadFilters, err := fetchNewadFilters(session.client.GetFiltersSectionNewad)
+	if err != nil {
+		return err
+	}
+	previousAdDetails := session.listing.AdDetails
+	session.listing.Category = code
+	session.listing.AdDetails = restoreAdDetails(newadFilters.Newad.ParamMap, newadFilters.Newad.SettingsParams, *session.listing, previousAdDetails)
+	return nil
+}
+
+func fetchCategories(get func() (tori.Categories, error)) (tori.Categories, error) {
+	if categories, ok := getCachedCategories(); ok {
+		return categories, nil
+	}
+	categories, err := get()
+	if err != nil {
+		return categories, err
+	}
+	setCachedCategories(categories)
+	return categories, nil
+}
+
+// warnAboutDescriptionQuality replies with a hint if the listing's body looks
+// too thin, when user has opted in to the check. The check is only advisory,
+// so the listing can be sent anyway.
+func warnAboutDescriptionQuality(session *UserSession) {
+	if !session.descriptionQualityCheck || session.listing.Body == "" {
+		return
+	}
+	if ok, hint := tori.AssessDescriptionQuality(session.listing.Subject, session.listing.Body); !ok {
+		session.reply(hint)
+	}
+}
+
 func checkUserPreconditions(session *UserSession) string {
 	// Check that access token is valid
 	account, err := session.client.GetAccount(session.toriAccountId)
 	if err != nil {
-		log.Error().Err(err).Msg("precondition check failed: could not get account from tori")
+		withResponseError(session.logger().Error(), err).Err(err).Msg("precondition check failed: could not get account from tori")
 		return sessionMaybeExpiredText
 	}
 
 	// Tori account needs to have location set so that it can be added to listing
 	if len(account.Locations) == 0 {
-		log.Error().Msg("precondition check failed: account does not have locations set")
+		session.logger().Error().Msg("precondition check failed: account does not have locations set")
 		return noLocationsInToriAccountText
 	}
 
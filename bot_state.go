@@ -20,16 +20,39 @@ func (bs *BotState) newUserSession(userId int64) (*UserSession, error) {
 		return nil, errors.Errorf("user %d has no config; if this is you, add user with telegramUserId = %d to user_config.toml", userId, userId)
 	}
 
+	commandAliases := cfg.CommandAliases
+	if commandAliases == nil {
+		commandAliases = defaultCommandAliases
+	}
+
 	session := UserSession{
-		userId:        userId,
-		toriAccountId: cfg.ToriAccountId,
+		userId:                  userId,
+		toriAccountId:           cfg.ToriAccountId,
+		minPhotos:               cfg.MinPhotos,
+		showPhone:               cfg.ShowPhone,
+		descriptionQualityCheck: cfg.DescriptionQualityCheck,
+		confirmCategory:         cfg.ConfirmCategory,
+		giveByDefault:           cfg.GiveByDefault,
+		commandAliases:          commandAliases,
 		client: tori.NewClient(tori.ClientOpts{
-			Auth:    cfg.Token,
-			BaseURL: bs.bot.toriApiBaseUrl,
+			Auth:             cfg.Token,
+			BaseURL:          bs.bot.toriApiBaseUrl,
+			RetryWaitTime:    bs.bot.toriRetryWaitTime,
+			RetryMaxWaitTime: bs.bot.toriRetryWaitTime,
 		}),
 		bot: bs.bot,
 	}
 	log.Info().Int64("userId", userId).Msg("new user session created")
+
+	if store := bs.bot.listingStore; store != nil {
+		saved, err := store.Load(userId)
+		if err != nil {
+			log.Error().Err(err).Int64("userId", userId).Msg("failed to load saved listing")
+		} else if saved != nil {
+			session.restoreListing(*saved)
+		}
+	}
+
 	return &session, nil
 }
 
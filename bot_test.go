@@ -3,10 +3,13 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -16,6 +19,8 @@ import (
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/lithammer/dedent"
 	"github.com/raine/telegram-tori-bot/tori"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -24,6 +29,9 @@ func setupWithTestServer(t *testing.T, ts *httptest.Server) (*httptest.Server, i
 	userId := int64(1)
 	tg := new(botApiMock)
 	bot := NewBot(tg, userConfigMap, ts.URL)
+	// Failing requests are retried, which should not slow down tests
+	bot.toriRetryWaitTime = time.Millisecond
+	bot.sendRetryDelay = time.Millisecond
 	session, err := bot.state.getUserSession(userId)
 	if err != nil {
 		t.Fatal(err)
@@ -124,6 +132,9 @@ func makeTestServerWithOnReqFn(t *testing.T, onReq func(r *http.Request)) *httpt
 			w.Write(makeListingResponse(t, "2", tori.Category{Code: "5022", Label: "Televisiot"}))
 		case "GET /v2/listings/4":
 			w.Write(makeListingResponse(t, "4", tori.Category{Code: "5031", Label: "Tabletit"}))
+		case "GET /v1.2/public/categories/insert":
+			b, err = json.Marshal(testCategories)
+			w.Write(b)
 		case "GET /v1.2/public/filters":
 			b, err = ioutil.ReadFile("tori/testdata/v1_2_public_filters_section_newad.json")
 			w.Write(b)
@@ -143,6 +154,9 @@ func makeTestServerWithOnReqFn(t *testing.T, onReq func(r *http.Request)) *httpt
 			w.Write(responseJson)
 		case "GET /1.jpg", "GET /2.jpg":
 			w.Write([]byte("123"))
+		// Photos added in tests, with different contents
+		case "GET /a.jpg", "GET /b.jpg", "GET /c.jpg":
+			w.Write([]byte(r.URL.Path))
 		// For testing JSON archive import
 		case "GET /archive.json":
 			b, err := ioutil.ReadFile("testdata/archive.json")
@@ -159,6 +173,25 @@ func makeTestServerWithOnReqFn(t *testing.T, onReq func(r *http.Request)) *httpt
 	}))
 }
 
+var testCategories = tori.Categories{
+	Categories: []tori.Category{
+		{
+			Code:  "5000",
+			Label: "ELEKTRONIIKKA",
+			Categories: []tori.Category{
+				{
+					Code:  "5010",
+					Label: "Puhelimet ja tarvikkeet",
+					Categories: []tori.Category{
+						{Code: "5012", Label: "Puhelimet"},
+						{Code: "5031", Label: "Tabletit", MaxImages: 1},
+					},
+				},
+			},
+		},
+	},
+}
+
 func makeTestServer(t *testing.T) *httptest.Server {
 	return makeTestServerWithOnReqFn(t, func(r *http.Request) {})
 }
@@ -185,7 +218,7 @@ func TestHandleUpdate_ListingStart(t *testing.T) {
 	update := makeUpdateWithMessageText(userId, "iPhone 12")
 
 	tg.On("Send", makeMessage(userId, "*Ilmoituksen otsikko:* iPhone 12")).Return(tgbotapi.Message{}, nil).Once()
-	tg.On("Send", makeMessageWithFn(userId, "*Osasto:* Puhelimet\n", func(msg *tgbotapi.MessageConfig) {
+	tg.On("Send", makeMessageWithFn(userId, "*Osasto:* Puhelimet\n\n1. Puhelimet\n2. Televisiot\n3. Tabletit\n\nVaihda osastoa napeista tai vastaamalla tähän viestiin osaston numerolla.", func(msg *tgbotapi.MessageConfig) {
 		msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{
 			InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{
 				{
@@ -203,9 +236,12 @@ func TestHandleUpdate_ListingStart(t *testing.T) {
 	bot.handleUpdate(update)
 	tg.AssertExpectations(t)
 
+	assert.NotEmpty(t, session.listingId)
+
 	// Skip these fields as they are difficult and not very fruitful to assert
 	session.client = nil
 	session.bot = nil
+	session.listingId = ""
 
 	assert.Equal(t, &UserSession{
 		userId: 1,
@@ -460,6 +496,8 @@ func TestHandleUpdate_AddPhoto(t *testing.T) {
 	assert.Eventually(
 		t,
 		func() bool {
+			session.mu.Lock()
+			defer session.mu.Unlock()
 			return len(session.photos) == 3
 		},
 		time.Millisecond*100,
@@ -487,7 +525,7 @@ func TestHandleUpdate_AddPhotoInSameMessageAsSubject(t *testing.T) {
 	tg.On("Send", makeMessage(userId, "*Ilmoituksen otsikko:* iPhone 12")).Return(tgbotapi.Message{}, nil).Once()
 	tg.On("Send", makeMessage(userId, "Ilmoitusteksti?")).Return(tgbotapi.Message{}, nil).Once()
 	tg.On("Send", makeMessage(userId, "1 kuva lisätty")).Return(tgbotapi.Message{}, nil).Once()
-	tg.On("Send", makeMessageWithFn(userId, "*Osasto:* Puhelimet\n", func(msg *tgbotapi.MessageConfig) {
+	tg.On("Send", makeMessageWithFn(userId, "*Osasto:* Puhelimet\n\n1. Puhelimet\n2. Televisiot\n3. Tabletit\n\nVaihda osastoa napeista tai vastaamalla tähän viestiin osaston numerolla.", func(msg *tgbotapi.MessageConfig) {
 		msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{
 			InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{
 				{
@@ -677,10 +715,95 @@ func TestHandleUpdate_RemovePhotosCommand(t *testing.T) {
 	assert.Empty(t, session.photos)
 }
 
+func TestHandleUpdate_PhotosCommand(t *testing.T) {
+	ts, userId, tg, bot, session := setup(t)
+	defer ts.Close()
+
+	session.listing = &tori.Listing{
+		Subject:  "foo",
+		Body:     "bar",
+		Category: "5012",
+		Type:     tori.ListingTypeSell,
+	}
+	session.photos = []tgbotapi.PhotoSize{
+		{FileID: "1", FileUniqueID: "1"},
+		{FileID: "2", FileUniqueID: "2"},
+		{FileID: "3", FileUniqueID: "3"},
+	}
+
+	makePhotosReply := func(photos []tgbotapi.PhotoSize) tgbotapi.MessageConfig {
+		return makeMessageWithFn(userId, fmt.Sprintf("Kuvia: %d. Ensimmäinen kuva on ilmoituksen pääkuva.", len(photos)), func(msg *tgbotapi.MessageConfig) {
+			msg.ParseMode = ""
+			msg.ReplyMarkup = makePhotosMessage(photos).ReplyMarkup
+		})
+	}
+
+	tg.On("Request", mock.AnythingOfType("tgbotapi.MediaGroupConfig")).
+		Return(&tgbotapi.APIResponse{}, nil).Once()
+	tg.On("Send", makePhotosReply(session.photos)).Return(tgbotapi.Message{}, nil).Once()
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/kuvat"))
+	tg.AssertExpectations(t)
+
+	makeCallback := func(data string) tgbotapi.Update {
+		return tgbotapi.Update{
+			CallbackQuery: &tgbotapi.CallbackQuery{
+				ID:      "1",
+				From:    &tgbotapi.User{ID: userId},
+				Message: &tgbotapi.Message{MessageID: 1},
+				Data:    data,
+			},
+		}
+	}
+
+	// After a change, the old buttons are removed and the photos are sent
+	// again with new numbers
+	tg.On("Request", tgbotapi.NewCallback("1", "")).Return(&tgbotapi.APIResponse{}, nil).Twice()
+	tg.On("Request", tgbotapi.NewDeleteMessage(userId, 1)).Return(&tgbotapi.APIResponse{}, nil).Twice()
+	tg.On("Request", mock.AnythingOfType("tgbotapi.MediaGroupConfig")).
+		Return(&tgbotapi.APIResponse{}, nil).Twice()
+
+	tg.On("Send", makePhotosReply([]tgbotapi.PhotoSize{
+		{FileID: "3", FileUniqueID: "3"},
+		{FileID: "1", FileUniqueID: "1"},
+		{FileID: "2", FileUniqueID: "2"},
+	})).Return(tgbotapi.Message{}, nil).Once()
+	bot.handleUpdate(makeCallback("photos:cover:3"))
+	assert.Equal(t, []string{"3", "1", "2"}, photoFileIds(session.photos))
+
+	tg.On("Send", makePhotosReply([]tgbotapi.PhotoSize{
+		{FileID: "3", FileUniqueID: "3"},
+		{FileID: "2", FileUniqueID: "2"},
+	})).Return(tgbotapi.Message{}, nil).Once()
+	bot.handleUpdate(makeCallback("photos:delete:1"))
+	assert.Equal(t, []string{"3", "2"}, photoFileIds(session.photos))
+
+	// A button for a photo that was already deleted, e.g. in an older
+	// message, changes nothing
+	tg.On("Request", tgbotapi.CallbackConfig{CallbackQueryID: "1", Text: "Kuva on jo poistettu."}).
+		Return(&tgbotapi.APIResponse{}, nil).Once()
+	bot.handleUpdate(makeCallback("photos:delete:1"))
+	assert.Equal(t, []string{"3", "2"}, photoFileIds(session.photos))
+	tg.AssertExpectations(t)
+}
+
+func photoFileIds(photos []tgbotapi.PhotoSize) []string {
+	ids := make([]string, 0, len(photos))
+	for _, p := range photos {
+		ids = append(ids, p.FileID)
+	}
+	return ids
+}
+
 func TestHandleUpdate_EditSubject(t *testing.T) {
 	ts, userId, tg, bot, session := setup(t)
 	defer ts.Close()
 
+	store, err := NewListingStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot.listingStore = store
+
 	session.userSubjectMessageId = 10
 	session.botSubjectMessageId = 20
 	session.listing = &tori.Listing{
@@ -711,6 +834,12 @@ func TestHandleUpdate_EditSubject(t *testing.T) {
 		Category: "5012",
 		Type:     tori.ListingTypeSell,
 	}, session.listing)
+
+	// Edited subject is kept over a restart
+	saved, err := store.Load(userId)
+	assert.NoError(t, err)
+	assert.Equal(t, "iPhone 13", saved.Listing.Subject)
+	assert.Equal(t, 10, saved.UserSubjectMessageId)
 }
 
 func TestHandleUpdate_EditBody(t *testing.T) {
@@ -749,6 +878,36 @@ func TestHandleUpdate_EditBody(t *testing.T) {
 	}, session.listing)
 }
 
+func TestHandleUpdate_EditBodyWarnsAboutDescriptionQuality(t *testing.T) {
+	ts, userId, tg, bot, session := setup(t)
+	defer ts.Close()
+
+	session.descriptionQualityCheck = true
+	session.userBodyMessageId = 10
+	session.botBodyMessageId = 20
+	session.listing = &tori.Listing{
+		Subject:  "iPhone 12",
+		Body:     "Myydään käytetty iPhone 12, akun kunto 90 %, ei naarmuja",
+		Category: "5012",
+		Type:     tori.ListingTypeSell,
+	}
+
+	update := tgbotapi.Update{
+		EditedMessage: &tgbotapi.Message{
+			MessageID: 10,
+			From:      &tgbotapi.User{ID: userId},
+			Text:      "iPhone 12",
+		},
+	}
+
+	tg.On("Send", mock.AnythingOfType("tgbotapi.EditMessageTextConfig")).Return(tgbotapi.Message{}, nil).Once()
+	tg.On("Send", makeMessage(userId, "Ilmoitusteksti on sama kuin otsikko. Kerro tuotteesta jotain, mitä otsikossa ei ole.")).
+		Return(tgbotapi.Message{}, nil).Once()
+
+	bot.handleUpdate(update)
+	tg.AssertExpectations(t)
+}
+
 func TestHandleUpdate_UnauthorizedAccess(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
 		t.Fatal("no requests expected")
@@ -861,3 +1020,1291 @@ func TestHandleUpdate_ForgetPrice(t *testing.T) {
 
 	assert.Equal(t, tori.Price(0), session.listing.Price)
 }
+
+func TestHandleUpdate_AddCategoryAlias(t *testing.T) {
+	ts, userId, tg, bot, session := setup(t)
+	defer ts.Close()
+
+	tg.On("Send", makeMessage(userId, "Alias puh lisätty osastolle Puhelimet.")).
+		Return(tgbotapi.Message{}, nil).Once()
+
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/lisaa-alias Puh 5012"))
+	tg.AssertExpectations(t)
+
+	assert.Equal(t, map[string]tori.Category{
+		"puh": {Code: "5012", Label: "Puhelimet"},
+	}, session.categoryAliases)
+}
+
+func TestHandleUpdate_AddCategoryAliasInvalidCategory(t *testing.T) {
+	ts, userId, tg, bot, session := setup(t)
+	defer ts.Close()
+
+	tg.On("Send", makeMessage(userId, "Osastokoodilla 5010 ei löytynyt osastoa, johon voi lisätä ilmoituksen.")).
+		Return(tgbotapi.Message{}, nil).Once()
+
+	// 5010 is not a leaf category
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/lisaa-alias puh 5010"))
+	tg.AssertExpectations(t)
+
+	assert.Empty(t, session.categoryAliases)
+}
+
+func TestHandleUpdate_CategoryCommandWithAlias(t *testing.T) {
+	ts, userId, tg, bot, session := setup(t)
+	defer ts.Close()
+
+	// No params in filters, so that nothing is missing from the listing after
+	// category is changed
+	setCachedNewadFilters(tori.NewadFilters{})
+	defer clearCachedNewadFilters()
+
+	session.categoryAliases = map[string]tori.Category{
+		"puh": {Code: "5012", Label: "Puhelimet"},
+	}
+	session.listing = &tori.Listing{
+		Subject:  "iPhone 12",
+		Body:     "Myydään käytetty iPhone 12",
+		Category: "5022",
+		Type:     tori.ListingTypeSell,
+		AdDetails: tori.AdDetails{
+			"general_condition": "new",
+		},
+	}
+	// Choosing the category with an alias confirms it
+	session.categoryUnconfirmed = true
+
+	tg.On("Send", makeMessage(userId, "*Osasto:* Puhelimet")).
+		Return(tgbotapi.Message{}, nil).Once()
+
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/osasto puh"))
+	tg.AssertExpectations(t)
+
+	assert.False(t, session.categoryUnconfirmed)
+	assert.Equal(t, &tori.Listing{
+		Subject:  "iPhone 12",
+		Body:     "Myydään käytetty iPhone 12",
+		Category: "5012",
+		Type:     tori.ListingTypeSell,
+	}, session.listing)
+}
+
+func TestHandleUpdate_SearchCategoryCommand(t *testing.T) {
+	ts, userId, tg, bot, session := setup(t)
+	defer ts.Close()
+
+	session.listing = &tori.Listing{
+		Subject:  "iPad",
+		Category: "5012",
+		Type:     tori.ListingTypeSell,
+	}
+
+	tg.On("Send", makeMessageWithFn(userId, "Valitse osasto:", func(msg *tgbotapi.MessageConfig) {
+		msg.ParseMode = ""
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("Puhelimet ja tarvikkeet › Tabletit", "category:5031"),
+			),
+		)
+	})).Return(tgbotapi.Message{}, nil).Once()
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/etsiosasto tabl"))
+
+	tg.On("Send", makeMessage(userId, "Hakusanoilla autot ei löytynyt osastoja.")).
+		Return(tgbotapi.Message{}, nil).Once()
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/etsiosasto autot"))
+	tg.AssertExpectations(t)
+}
+
+func TestHandleUpdate_SelectCategoryFromSearchResults(t *testing.T) {
+	ts, userId, tg, bot, session := setup(t)
+	defer ts.Close()
+
+	setCachedNewadFilters(tori.NewadFilters{})
+	defer clearCachedNewadFilters()
+
+	session.listing = &tori.Listing{
+		Subject:  "iPad",
+		Body:     "Myydään käytetty iPad",
+		Category: "5012",
+		Type:     tori.ListingTypeSell,
+	}
+	session.categoryUnconfirmed = true
+
+	editMsg := tgbotapi.NewEditMessageText(userId, 1, "*Osasto:* Tabletit")
+	editMsg.ParseMode = tgbotapi.ModeMarkdown
+	tg.On("Request", mock.AnythingOfType("tgbotapi.CallbackConfig")).
+		Return(&tgbotapi.APIResponse{}, nil).Once()
+	tg.On("Send", editMsg).Return(tgbotapi.Message{}, nil).Once()
+
+	bot.handleUpdate(tgbotapi.Update{
+		CallbackQuery: &tgbotapi.CallbackQuery{
+			ID:      "1",
+			From:    &tgbotapi.User{ID: userId},
+			Message: &tgbotapi.Message{MessageID: 1},
+			Data:    "category:5031",
+		},
+	})
+	tg.AssertExpectations(t)
+
+	assert.Equal(t, "5031", session.listing.Category)
+	assert.False(t, session.categoryUnconfirmed)
+}
+
+func TestHandleUpdate_EnterConditionWithTypo(t *testing.T) {
+	ts, userId, tg, bot, session := setup(t)
+	defer ts.Close()
+
+	setCachedNewadFilters(tori.NewadFilters{
+		Newad: tori.Newad{
+			ParamMap: tori.ParamMap{
+				"general_condition": {
+					SingleSelection: &tori.SingleSelection{
+						Label:    "Kunto",
+						ParamKey: "general_condition",
+						ValuesList: []tori.Value{
+							{Label: "Uusi", Value: "new"},
+							{Label: "Erinomainen", Value: "excellent"},
+						},
+					},
+				},
+			},
+			SettingsParams: []tori.SettingsParam{
+				{
+					Keys: []string{"category"},
+					Settings: []tori.Settings{
+						{SettingsResult: []string{"general_condition"}, Values: []string{"5012"}},
+					},
+				},
+			},
+		},
+	})
+	defer clearCachedNewadFilters()
+
+	session.listing = &tori.Listing{
+		Subject:  "iPhone 12",
+		Body:     "Myydään käytetty iPhone 12",
+		Category: "5012",
+		Type:     tori.ListingTypeSell,
+		Price:    50,
+	}
+
+	tg.On("Send", makeMessage(userId, "*Kunto:* Erinomainen")).
+		Return(tgbotapi.Message{}, nil).Once()
+	tg.On("Send", makeMessageWithRemoveReplyKeyboard(userId, fmt.Sprintf("%s\n%s", listingReadyToBeSentNoImagesText, listingReadyCommands))).
+		Return(tgbotapi.Message{}, nil).Once()
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "erinomanen"))
+	tg.AssertExpectations(t)
+
+	assert.Equal(t, "excellent", session.listing.AdDetails["general_condition"])
+}
+
+func TestHandleUpdate_BrowseCategories(t *testing.T) {
+	ts, userId, tg, bot, session := setup(t)
+	defer ts.Close()
+
+	setCachedNewadFilters(tori.NewadFilters{})
+	defer clearCachedNewadFilters()
+
+	session.listing = &tori.Listing{
+		Subject:  "iPhone 12",
+		Body:     "Myydään käytetty iPhone 12",
+		Category: "5022",
+		Type:     tori.ListingTypeSell,
+		AdDetails: tori.AdDetails{
+			"general_condition": "new",
+		},
+	}
+
+	rootsMsg := makeCategoryBrowseMessage(nil, testCategories.Categories, "")
+	rootsMsg.ChatID = userId
+	tg.On("Send", rootsMsg).Return(tgbotapi.Message{}, nil).Once()
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/osasto"))
+	tg.AssertExpectations(t)
+
+	makeCallback := func(data string) tgbotapi.Update {
+		return tgbotapi.Update{
+			CallbackQuery: &tgbotapi.CallbackQuery{
+				ID:      "1",
+				From:    &tgbotapi.User{ID: userId},
+				Message: &tgbotapi.Message{MessageID: 1},
+				Data:    data,
+			},
+		}
+	}
+	makeEditMsg := func(msg tgbotapi.MessageConfig) tgbotapi.EditMessageTextConfig {
+		editMsg := tgbotapi.NewEditMessageText(userId, 1, msg.Text)
+		if markup, ok := msg.ReplyMarkup.(tgbotapi.InlineKeyboardMarkup); ok {
+			editMsg.ReplyMarkup = &markup
+		}
+		editMsg.ParseMode = tgbotapi.ModeMarkdown
+		return editMsg
+	}
+
+	electronics := testCategories.Categories[0]
+	phones := electronics.Categories[0]
+	tg.On("Request", mock.AnythingOfType("tgbotapi.CallbackConfig")).
+		Return(&tgbotapi.APIResponse{}, nil).Times(3)
+	tg.On("Send", makeEditMsg(makeCategoryBrowseMessage(&electronics, electronics.Categories, ""))).
+		Return(tgbotapi.Message{}, nil).Once()
+	tg.On("Send", makeEditMsg(makeCategoryBrowseMessage(&phones, phones.Categories, "5000"))).
+		Return(tgbotapi.Message{}, nil).Once()
+	tg.On("Send", makeEditMsg(tgbotapi.NewMessage(0, "*Osasto:* Puhelimet"))).
+		Return(tgbotapi.Message{}, nil).Once()
+
+	bot.handleUpdate(makeCallback("browse:5000"))
+	bot.handleUpdate(makeCallback("browse:5010"))
+	bot.handleUpdate(makeCallback("browse:5012"))
+	tg.AssertExpectations(t)
+
+	assert.Equal(t, &tori.Listing{
+		Subject:  "iPhone 12",
+		Body:     "Myydään käytetty iPhone 12",
+		Category: "5012",
+		Type:     tori.ListingTypeSell,
+	}, session.listing)
+}
+
+func TestHandleUpdate_SendListingWithTooFewPhotos(t *testing.T) {
+	ts, userId, tg, bot, session := setup(t)
+	defer ts.Close()
+
+	session.minPhotos = 2
+	session.listing = &tori.Listing{
+		Subject:  "iPhone 12",
+		Body:     "Myydään käytetty iPhone 12",
+		Category: "5012",
+		Type:     tori.ListingTypeSell,
+		Price:    50,
+	}
+	session.photos = []tgbotapi.PhotoSize{
+		{FileID: "1", FileUniqueID: "1", Width: 371, Height: 495, FileSize: 28548},
+	}
+
+	tg.On("Send", makeMessage(userId, "Lähetä vielä 1 kuva ennen ilmoituksen lähettämistä.")).
+		Return(tgbotapi.Message{}, nil).Once()
+
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/laheta"))
+	tg.AssertExpectations(t)
+
+	assert.NotNil(t, session.listing)
+}
+
+// makeSendListingTestServer creates a test server that responds to the
+// requests made when a listing is sent, without depending on testdata
+func makeSendListingTestServer(t *testing.T, onPostListing func(b []byte)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methodAndPath := fmt.Sprintf("%s %s", r.Method, r.URL.Path)
+		switch methodAndPath {
+		case "GET /v1.2/private/accounts/123123":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"account":{"account_id":"/private/accounts/123123","locations":[{"code":"18","locations":[{"code":"313","locations":[{"code":"00320"}]}]}]}}`))
+		case "POST /v2.2/media":
+			w.Header().Set("Content-Type", "plain/text")
+			w.Write([]byte(`{"image":{"id":"a","url":""}}`))
+		case "POST /v2/listings":
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			onPostListing(b)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("{}"))
+		case "GET /v1.2/public/categories/insert":
+			b, err := json.Marshal(testCategories)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+		case "GET /1.jpg", "GET /2.jpg":
+			w.Write([]byte("123"))
+		default:
+			t.Fatal(fmt.Sprintf("invalid request to test server: %s %s", r.Method, r.URL.Path))
+		}
+	}))
+}
+
+func TestHandleUpdate_SendListingPhonePreference(t *testing.T) {
+	tests := map[string]struct {
+		showPhone       bool
+		wantPhoneHidden bool
+	}{
+		"chat only":   {showPhone: false, wantPhoneHidden: true},
+		"phone shown": {showPhone: true, wantPhoneHidden: false},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var postedListing tori.Listing
+			ts := makeSendListingTestServer(t, func(b []byte) {
+				if err := json.Unmarshal(b, &postedListing); err != nil {
+					t.Fatal(err)
+				}
+			})
+			ts, userId, tg, bot, session := setupWithTestServer(t, ts)
+			defer ts.Close()
+
+			// No params in filters, so that nothing is missing from the listing
+			setCachedNewadFilters(tori.NewadFilters{})
+			defer clearCachedNewadFilters()
+
+			session.showPhone = tc.showPhone
+			session.listing = &tori.Listing{
+				Subject:  "iPhone 12",
+				Body:     "Myydään käytetty iPhone 12",
+				Category: "5012",
+				Type:     tori.ListingTypeSell,
+				Price:    50,
+			}
+			session.photos = []tgbotapi.PhotoSize{
+				{FileID: "1", FileUniqueID: "1", Width: 371, Height: 495, FileSize: 28548},
+			}
+
+			tg.On("GetFileDirectURL", "1").Return(ts.URL+"/1.jpg", nil).Once()
+			tg.On("Send", makeMessageWithRemoveReplyKeyboard(userId, "Ilmoitus lähetetty!")).Return(tgbotapi.Message{}, nil).Once()
+			tg.On("Send", mock.AnythingOfType("tgbotapi.DocumentConfig")).Return(tgbotapi.Message{}, nil).Once()
+
+			bot.handleUpdate(makeUpdateWithMessageText(userId, "/laheta"))
+			tg.AssertExpectations(t)
+
+			assert.Equal(t, tc.wantPhoneHidden, postedListing.PhoneHidden)
+		})
+	}
+}
+
+func TestHandleUpdate_SendListingWithTooManyPhotos(t *testing.T) {
+	var postedListing tori.Listing
+	ts := makeSendListingTestServer(t, func(b []byte) {
+		if err := json.Unmarshal(b, &postedListing); err != nil {
+			t.Fatal(err)
+		}
+	})
+	ts, userId, tg, bot, session := setupWithTestServer(t, ts)
+	defer ts.Close()
+
+	// No params in filters, so that nothing is missing from the listing
+	setCachedNewadFilters(tori.NewadFilters{})
+	defer clearCachedNewadFilters()
+
+	// Tabletit category allows one image
+	session.listing = &tori.Listing{
+		Subject:  "iPad",
+		Body:     "Myydään käytetty iPad",
+		Category: "5031",
+		Type:     tori.ListingTypeSell,
+		Price:    50,
+	}
+	session.photos = []tgbotapi.PhotoSize{
+		{FileID: "1", FileUniqueID: "1", Width: 371, Height: 495, FileSize: 28548},
+		{FileID: "2", FileUniqueID: "2", Width: 371, Height: 495, FileSize: 28548},
+	}
+
+	tg.On("GetFileDirectURL", "1").Return(ts.URL+"/1.jpg", nil).Once()
+	tg.On("Send", makeMessage(userId, "Osastoon voi lisätä enintään 1 kuva, joten ylimääräiset jätettiin pois.")).Return(tgbotapi.Message{}, nil).Once()
+	tg.On("Send", makeMessageWithRemoveReplyKeyboard(userId, "Ilmoitus lähetetty!")).Return(tgbotapi.Message{}, nil).Once()
+	tg.On("Send", mock.AnythingOfType("tgbotapi.DocumentConfig")).Return(tgbotapi.Message{}, nil).Once()
+
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/laheta"))
+	tg.AssertExpectations(t)
+
+	assert.Equal(t, &[]tori.ListingMedia{{Id: "/public/media/ad/a"}}, postedListing.Images)
+}
+
+func TestHandleUpdate_SendListingWithTooManyPhotosKeepsPhotosOnFailure(t *testing.T) {
+	ts := makeSendListingTestServer(t, func(b []byte) {
+		t.Fatal("listing should not be posted when photo upload fails")
+	})
+	ts, userId, tg, bot, session := setupWithTestServer(t, ts)
+	defer ts.Close()
+
+	// No params in filters, so that nothing is missing from the listing
+	setCachedNewadFilters(tori.NewadFilters{})
+	defer clearCachedNewadFilters()
+
+	// Tabletit category allows one image
+	session.listing = &tori.Listing{
+		Subject:  "iPad",
+		Body:     "Myydään käytetty iPad",
+		Category: "5031",
+		Type:     tori.ListingTypeSell,
+		Price:    50,
+	}
+	photos := []tgbotapi.PhotoSize{
+		{FileID: "1", FileUniqueID: "1", Width: 371, Height: 495, FileSize: 28548},
+		{FileID: "2", FileUniqueID: "2", Width: 371, Height: 495, FileSize: 28548},
+	}
+	session.photos = photos
+
+	tg.On("GetFileDirectURL", "1").Return("", errors.New("telegram is down")).Once()
+	tg.On("Send", mock.AnythingOfType("tgbotapi.MessageConfig")).Return(tgbotapi.Message{}, nil).Twice()
+
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/laheta"))
+	tg.AssertExpectations(t)
+
+	assert.Equal(t, photos, session.photos)
+}
+
+func TestHandleUpdate_CheckListingShowsPhotos(t *testing.T) {
+	ts := makeSendListingTestServer(t, func(b []byte) {})
+	ts, userId, tg, bot, session := setupWithTestServer(t, ts)
+	defer ts.Close()
+
+	// No params in filters, so that nothing is missing from the listing
+	setCachedNewadFilters(tori.NewadFilters{})
+	defer clearCachedNewadFilters()
+
+	session.listing = &tori.Listing{
+		Subject:  "iPhone 12",
+		Body:     "Myydään käytetty iPhone 12",
+		Category: "5012",
+		Type:     tori.ListingTypeSell,
+		Price:    50,
+	}
+	session.photos = []tgbotapi.PhotoSize{
+		{FileID: "1", FileUniqueID: "1"},
+		{FileID: "2", FileUniqueID: "2"},
+	}
+
+	first := tgbotapi.NewInputMediaPhoto(tgbotapi.FileID("1"))
+	first.Caption = "1"
+	second := tgbotapi.NewInputMediaPhoto(tgbotapi.FileID("2"))
+	second.Caption = "2"
+	tg.On("Request", tgbotapi.NewMediaGroup(userId, []interface{}{first, second})).
+		Return(&tgbotapi.APIResponse{}, nil).Once()
+	tg.On("Send", makeMessage(userId, "*Tarkistus:*\n✅ Otsikko\n✅ Ilmoitusteksti\n✅ Osasto\n✅ Kentät\n✅ Kuvat (2)\n✅ Tilin paikkakunta\n\nIlmoitus on valmis lähetettäväksi.")).
+		Return(tgbotapi.Message{}, nil).Once()
+
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/tarkista"))
+	tg.AssertExpectations(t)
+}
+
+func TestHandleUpdate_SendListingDryRun(t *testing.T) {
+	ts := makeSendListingTestServer(t, func(b []byte) {
+		t.Fatal("listing should not be posted in dry run")
+	})
+	ts, userId, tg, bot, session := setupWithTestServer(t, ts)
+	defer ts.Close()
+
+	// No params in filters, so that nothing is missing from the listing
+	setCachedNewadFilters(tori.NewadFilters{})
+	defer clearCachedNewadFilters()
+
+	bot.dryRun = true
+	session.listing = &tori.Listing{
+		Subject:  "iPhone 12",
+		Body:     "Myydään käytetty iPhone 12",
+		Category: "5012",
+		Type:     tori.ListingTypeSell,
+		Price:    50,
+	}
+	session.photos = []tgbotapi.PhotoSize{
+		{FileID: "1", FileUniqueID: "1", Width: 371, Height: 495, FileSize: 28548},
+	}
+
+	tg.On("GetFileDirectURL", "1").Return(ts.URL+"/1.jpg", nil).Once()
+	tg.On("Send", makeMessage(userId, "Kuivaharjoitus: ilmoitusta ei lähetetty. Ilmoituksen tiedot on kirjattu lokiin.")).Return(tgbotapi.Message{}, nil).Once()
+
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/laheta"))
+	tg.AssertExpectations(t)
+
+	// Listing is kept so that it can be sent again
+	assert.NotNil(t, session.listing)
+	assert.Equal(t, &[]tori.ListingMedia{{Id: "/public/media/ad/a"}}, session.listing.Images)
+}
+
+func TestRetryOnError(t *testing.T) {
+	dialErr := &url.Error{Op: "Post", URL: "/v2/listings", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}
+	readErr := &url.Error{Op: "Post", URL: "/v2/listings", Err: &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}}
+	gatewayTimeoutErr := &tori.ResponseError{Method: "POST", URL: "/v2/listings", StatusCode: http.StatusGatewayTimeout}
+
+	tests := map[string]struct {
+		delay     time.Duration
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		"succeeds on retry": {
+			delay:     time.Millisecond,
+			errs:      []error{dialErr, nil},
+			wantCalls: 2,
+			wantErr:   nil,
+		},
+		"fails on retry": {
+			delay:     time.Millisecond,
+			errs:      []error{dialErr, dialErr},
+			wantCalls: 2,
+			wantErr:   dialErr,
+		},
+		"error that is not retryable": {
+			delay:     time.Millisecond,
+			errs:      []error{gatewayTimeoutErr},
+			wantCalls: 1,
+			wantErr:   gatewayTimeoutErr,
+		},
+		"retrying disabled": {
+			delay:     0,
+			errs:      []error{dialErr},
+			wantCalls: 1,
+			wantErr:   dialErr,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			calls := 0
+			err := retryOnError(&log.Logger, tc.delay, isConnectionError, func() error {
+				err := tc.errs[calls]
+				calls++
+				return err
+			})
+			assert.Equal(t, tc.wantCalls, calls)
+			assert.Equal(t, tc.wantErr, err)
+		})
+	}
+
+	// Connection lost after sending may come after the request was processed
+	assert.True(t, isConnectionError(dialErr))
+	assert.False(t, isConnectionError(readErr))
+	assert.False(t, isConnectionError(gatewayTimeoutErr))
+
+	assert.True(t, isTransientError(readErr))
+	assert.True(t, isTransientError(gatewayTimeoutErr))
+	assert.True(t, isTransientError(&tori.ResponseError{StatusCode: http.StatusTooManyRequests}))
+	assert.False(t, isTransientError(&tori.ResponseError{StatusCode: http.StatusBadRequest}))
+}
+
+func TestHandleUpdate_SendListingRetriesPhotoUpload(t *testing.T) {
+	var postedListing tori.Listing
+	sendListingTs := makeSendListingTestServer(t, func(b []byte) {
+		if err := json.Unmarshal(b, &postedListing); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer sendListingTs.Close()
+
+	var accountFetches, mediaUploads, listingPosts int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch fmt.Sprintf("%s %s", r.Method, r.URL.Path) {
+		case "GET /v1.2/private/accounts/123123":
+			accountFetches++
+		case "POST /v2.2/media":
+			mediaUploads++
+			if mediaUploads == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		case "POST /v2/listings":
+			listingPosts++
+		}
+		sendListingTs.Config.Handler.ServeHTTP(w, r)
+	}))
+	ts, userId, tg, bot, session := setupWithTestServer(t, ts)
+	defer ts.Close()
+
+	// No params in filters, so that nothing is missing from the listing
+	setCachedNewadFilters(tori.NewadFilters{})
+	defer clearCachedNewadFilters()
+
+	bot.sendRetryDelay = time.Millisecond
+	session.listing = &tori.Listing{
+		Subject:  "iPhone 12",
+		Body:     "Myydään käytetty iPhone 12",
+		Category: "5012",
+		Type:     tori.ListingTypeSell,
+		Price:    50,
+	}
+	session.photos = []tgbotapi.PhotoSize{
+		{FileID: "1", FileUniqueID: "1", Width: 371, Height: 495, FileSize: 28548},
+	}
+
+	tg.On("GetFileDirectURL", "1").Return(ts.URL+"/1.jpg", nil).Once()
+	tg.On("Send", makeMessageWithRemoveReplyKeyboard(userId, "Ilmoitus lähetetty!")).Return(tgbotapi.Message{}, nil).Once()
+	tg.On("Send", mock.AnythingOfType("tgbotapi.DocumentConfig")).Return(tgbotapi.Message{}, nil).Once()
+
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/laheta"))
+	tg.AssertExpectations(t)
+
+	// Only the failed step is made again
+	assert.Equal(t, 2, mediaUploads)
+	assert.Equal(t, 1, accountFetches)
+	assert.Equal(t, 1, listingPosts)
+	assert.Equal(t, &[]tori.ListingMedia{{Id: "/public/media/ad/a"}}, postedListing.Images)
+}
+
+func TestHandleUpdate_SendListingWarnsAboutDescriptionQuality(t *testing.T) {
+	ts := makeSendListingTestServer(t, func(b []byte) {})
+	ts, userId, tg, bot, session := setupWithTestServer(t, ts)
+	defer ts.Close()
+
+	// No params in filters, so that nothing is missing from the listing
+	setCachedNewadFilters(tori.NewadFilters{})
+	defer clearCachedNewadFilters()
+
+	session.descriptionQualityCheck = true
+	session.listing = &tori.Listing{
+		Subject:  "iPhone 12",
+		Body:     "iPhone 12",
+		Category: "5012",
+		Type:     tori.ListingTypeSell,
+		Price:    50,
+	}
+
+	tg.On("Send", makeMessage(userId, "Ilmoitusteksti on sama kuin otsikko. Kerro tuotteesta jotain, mitä otsikossa ei ole.")).
+		Return(tgbotapi.Message{}, nil).Once()
+	tg.On("Send", makeMessageWithRemoveReplyKeyboard(userId, "Ilmoitus lähetetty!")).Return(tgbotapi.Message{}, nil).Once()
+	tg.On("Send", mock.AnythingOfType("tgbotapi.DocumentConfig")).Return(tgbotapi.Message{}, nil).Once()
+
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/laheta"))
+	tg.AssertExpectations(t)
+}
+
+func TestHandleUpdate_SendListingGatewayTimeout(t *testing.T) {
+	sendListingTs := makeSendListingTestServer(t, func(b []byte) {})
+	defer sendListingTs.Close()
+
+	var mediaUploads, listingPosts int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch fmt.Sprintf("%s %s", r.Method, r.URL.Path) {
+		case "POST /v2.2/media":
+			mediaUploads++
+		case "POST /v2/listings":
+			// Tori may have created the listing even though the gateway
+			// timed out
+			listingPosts++
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		sendListingTs.Config.Handler.ServeHTTP(w, r)
+	}))
+	ts, userId, tg, bot, session := setupWithTestServer(t, ts)
+	defer ts.Close()
+
+	// No params in filters, so that nothing is missing from the listing
+	setCachedNewadFilters(tori.NewadFilters{})
+	defer clearCachedNewadFilters()
+
+	bot.sendRetryDelay = time.Millisecond
+	session.listing = &tori.Listing{
+		Subject:  "iPhone 12",
+		Body:     "Myydään käytetty iPhone 12",
+		Category: "5012",
+		Type:     tori.ListingTypeSell,
+		Price:    50,
+	}
+	session.photos = []tgbotapi.PhotoSize{
+		{FileID: "1", FileUniqueID: "1", Width: 371, Height: 495, FileSize: 28548},
+		{FileID: "2", FileUniqueID: "2", Width: 371, Height: 495, FileSize: 28548},
+	}
+
+	tg.On("GetFileDirectURL", "1").Return(ts.URL+"/1.jpg", nil).Once()
+	tg.On("GetFileDirectURL", "2").Return(ts.URL+"/2.jpg", nil).Once()
+	tg.On("Send", mock.AnythingOfType("tgbotapi.MessageConfig")).Return(tgbotapi.Message{}, nil).Once()
+
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/laheta"))
+	tg.AssertExpectations(t)
+
+	assert.Equal(t, 1, listingPosts)
+	assert.Equal(t, 2, mediaUploads)
+	assert.NotNil(t, session.listing)
+}
+
+func TestHandleUpdate_LogsListingId(t *testing.T) {
+	var logs bytes.Buffer
+	defaultLogger := log.Logger
+	log.Logger = zerolog.New(&logs)
+	defer func() { log.Logger = defaultLogger }()
+
+	ts, userId, tg, bot, session := setup(t)
+	defer ts.Close()
+
+	session.minPhotos = 5
+
+	tg.On("GetFileDirectURL", "a").Return(ts.URL+"/archive.json", nil)
+	tg.On("Send", mock.AnythingOfType("tgbotapi.MessageConfig")).Return(tgbotapi.Message{}, nil)
+
+	bot.handleUpdate(tgbotapi.Update{
+		Message: &tgbotapi.Message{
+			From: &tgbotapi.User{ID: userId},
+			Text: "/tuojson",
+			ReplyToMessage: &tgbotapi.Message{
+				Document: &tgbotapi.Document{FileID: "a", MimeType: "application/json"},
+			},
+		},
+	})
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/laheta"))
+
+	listingId := session.listingId
+	assert.NotEmpty(t, listingId)
+
+	messagesWithListingId := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["listingId"] == listingId {
+			messagesWithListingId[entry["message"].(string)] = true
+		}
+	}
+
+	assert.True(t, messagesWithListingId["sent message"])
+	assert.True(t, messagesWithListingId["cannot send listing with too few photos"])
+}
+
+func TestHandleUpdate_LogsListingIdWhenSendingFails(t *testing.T) {
+	var logs bytes.Buffer
+	defaultLogger := log.Logger
+	log.Logger = zerolog.New(&logs)
+	defer func() { log.Logger = defaultLogger }()
+
+	sendListingTs := makeSendListingTestServer(t, func(b []byte) {})
+	defer sendListingTs.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/v2.2/media" {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("media error"))
+			return
+		}
+		sendListingTs.Config.Handler.ServeHTTP(w, r)
+	}))
+	ts, userId, tg, bot, session := setupWithTestServer(t, ts)
+	defer ts.Close()
+
+	// No params in filters, so that nothing is missing from the listing
+	setCachedNewadFilters(tori.NewadFilters{})
+	defer clearCachedNewadFilters()
+
+	session.startListing(&tori.Listing{
+		Subject:  "iPhone 12",
+		Body:     "Myydään käytetty iPhone 12",
+		Category: "5012",
+		Type:     tori.ListingTypeSell,
+		Price:    50,
+	})
+	session.photos = []tgbotapi.PhotoSize{
+		{FileID: "1", FileUniqueID: "1", Width: 371, Height: 495, FileSize: 28548},
+	}
+
+	tg.On("GetFileDirectURL", "1").Return(ts.URL+"/1.jpg", nil).Once()
+	tg.On("Send", mock.AnythingOfType("tgbotapi.MessageConfig")).Return(tgbotapi.Message{}, nil).Once()
+
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/laheta"))
+	tg.AssertExpectations(t)
+
+	var uploadFailed map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["message"] == "failed to upload photo to tori" {
+			uploadFailed = entry
+		}
+	}
+
+	if assert.NotNil(t, uploadFailed) {
+		assert.Equal(t, session.listingId, uploadFailed["listingId"])
+		assert.Equal(t, float64(http.StatusInternalServerError), uploadFailed["statusCode"])
+		assert.Equal(t, "media error", uploadFailed["response"])
+	}
+}
+
+func TestHandleUpdate_ExportAndImportSettings(t *testing.T) {
+	ts, userId, tg, bot, session := setup(t)
+	defer ts.Close()
+
+	aliases := map[string]tori.Category{
+		"puh": {Code: "5012", Label: "Puhelimet"},
+	}
+	session.categoryAliases = aliases
+
+	var settingsBytes []byte
+	tg.On("Send", mock.AnythingOfType("tgbotapi.DocumentConfig")).
+		Run(func(args mock.Arguments) {
+			document := args.Get(0).(tgbotapi.DocumentConfig)
+			settingsBytes = document.File.(tgbotapi.FileBytes).Bytes
+		}).
+		Return(tgbotapi.Message{}, nil).Once()
+
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/varmuuskopio"))
+
+	settingsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(settingsBytes)
+	}))
+	defer settingsServer.Close()
+
+	session.categoryAliases = nil
+	tg.On("GetFileDirectURL", "a").Return(settingsServer.URL+"/settings.json", nil)
+	tg.On("Send", makeMessage(userId, "Asetukset tuotu.")).Return(tgbotapi.Message{}, nil).Once()
+
+	bot.handleUpdate(tgbotapi.Update{
+		Message: &tgbotapi.Message{
+			From: &tgbotapi.User{ID: userId},
+			Text: "/tuoasetukset",
+			ReplyToMessage: &tgbotapi.Message{
+				Document: &tgbotapi.Document{FileID: "a", MimeType: "application/json"},
+			},
+		},
+	})
+	tg.AssertExpectations(t)
+
+	assert.Equal(t, aliases, session.categoryAliases)
+}
+
+func TestHandleUpdate_ImportSettingsMergesAndValidatesAliases(t *testing.T) {
+	ts, userId, tg, bot, session := setup(t)
+	defer ts.Close()
+
+	session.categoryAliases = map[string]tori.Category{
+		"tv": {Code: "5022", Label: "Televisiot"},
+	}
+
+	settingsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 5010 is not a leaf category and 9999 doesn't exist
+		w.Write([]byte(`{"categoryAliases": {
+			"Puh": {"code": "5012", "label": "Puhelimet"},
+			"elektro": {"code": "5010", "label": "Puhelimet ja tarvikkeet"},
+			"vanha": {"code": "9999", "label": "Vanha osasto"}
+		}}`))
+	}))
+	defer settingsServer.Close()
+
+	tg.On("GetFileDirectURL", "a").Return(settingsServer.URL+"/settings.json", nil)
+	tg.On("Send", makeMessage(userId, "Asetukset tuotu.")).Return(tgbotapi.Message{}, nil).Once()
+	tg.On("Send", makeMessage(userId, "Seuraavia aliaksia ei tuotu, koska niiden osastoon ei voi lisätä ilmoitusta: elektro, vanha")).
+		Return(tgbotapi.Message{}, nil).Once()
+
+	bot.handleUpdate(tgbotapi.Update{
+		Message: &tgbotapi.Message{
+			From: &tgbotapi.User{ID: userId},
+			Text: "/tuoasetukset",
+			ReplyToMessage: &tgbotapi.Message{
+				Document: &tgbotapi.Document{FileID: "a", MimeType: "application/json"},
+			},
+		},
+	})
+	tg.AssertExpectations(t)
+
+	assert.Equal(t, "5012", session.categoryAliases["puh"].Code)
+	assert.Equal(t, "5022", session.categoryAliases["tv"].Code)
+	assert.Len(t, session.categoryAliases, 2)
+}
+
+func TestHandleUpdate_ImportSettingsWithoutAliasesKeepsAliases(t *testing.T) {
+	ts, userId, tg, bot, session := setup(t)
+	defer ts.Close()
+
+	aliases := map[string]tori.Category{
+		"tv": {Code: "5022", Label: "Televisiot"},
+	}
+	session.categoryAliases = aliases
+
+	settingsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer settingsServer.Close()
+
+	tg.On("GetFileDirectURL", "a").Return(settingsServer.URL+"/settings.json", nil)
+	tg.On("Send", makeMessage(userId, "Asetukset tuotu.")).Return(tgbotapi.Message{}, nil).Once()
+
+	bot.handleUpdate(tgbotapi.Update{
+		Message: &tgbotapi.Message{
+			From: &tgbotapi.User{ID: userId},
+			Text: "/tuoasetukset",
+			ReplyToMessage: &tgbotapi.Message{
+				Document: &tgbotapi.Document{FileID: "a", MimeType: "application/json"},
+			},
+		},
+	})
+	tg.AssertExpectations(t)
+
+	assert.Equal(t, aliases, session.categoryAliases)
+}
+
+func TestHandleUpdate_RestoreCancelledListing(t *testing.T) {
+	ts, userId, tg, bot, session := setup(t)
+	defer ts.Close()
+
+	// Price is missing, so the listing is cancelled without confirmation
+	setCachedNewadFilters(tori.NewadFilters{
+		Newad: tori.Newad{
+			SettingsParams: []tori.SettingsParam{
+				{
+					Keys: []string{"category"},
+					Settings: []tori.Settings{
+						{SettingsResult: []string{"price"}, Values: []string{"5012"}},
+					},
+				},
+			},
+		},
+	})
+	defer clearCachedNewadFilters()
+
+	listing := &tori.Listing{
+		Subject:  "iPhone 12",
+		Body:     "Myydään käytetty iPhone 12",
+		Category: "5012",
+		Type:     tori.ListingTypeSell,
+	}
+	photos := []tgbotapi.PhotoSize{
+		{FileID: "1", FileUniqueID: "1", Width: 371, Height: 495, FileSize: 28548},
+	}
+	session.startListing(listing)
+	session.photos = photos
+	listingId := session.listingId
+
+	tg.On("Send", makeMessageWithRemoveReplyKeyboard(userId, "Ok! Jos peruit vahingossa, saat ilmoituksen takaisin komennolla /perista parin minuutin ajan.")).
+		Return(tgbotapi.Message{}, nil).Once()
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/peru"))
+	assert.Nil(t, session.listing)
+
+	tg.On("Send", makeMessage(userId, "Ilmoitus palautettu: iPhone 12")).
+		Return(tgbotapi.Message{}, nil).Once()
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/perista"))
+
+	assert.Equal(t, listing, session.listing)
+	assert.Equal(t, photos, session.photos)
+	assert.Equal(t, listingId, session.listingId)
+
+	// The same listing can't be restored twice
+	session.reset()
+	tg.On("Send", makeMessage(userId, "Ei peruttua ilmoitusta, jonka voisi palauttaa.")).
+		Return(tgbotapi.Message{}, nil).Once()
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/perista"))
+	tg.AssertExpectations(t)
+}
+
+func TestHandleUpdate_ConfirmCategory(t *testing.T) {
+	ts, userId, tg, bot, session := setup(t)
+	defer ts.Close()
+
+	setCachedNewadFilters(tori.NewadFilters{})
+	defer clearCachedNewadFilters()
+
+	session.categories = []tori.Category{
+		{Code: "5012", Label: "Puhelimet"},
+		{Code: "5031", Label: "Tabletit"},
+	}
+	session.startListing(&tori.Listing{
+		Subject:  "iPhone 12",
+		Category: "5012",
+		Type:     tori.ListingTypeSell,
+	})
+	session.categoryUnconfirmed = true
+
+	tg.On("Send", makeMessage(userId, "Vahvista ensin osasto valitsemalla se osastoviestin napeista tai vastaamalla osaston numerolla.")).
+		Return(tgbotapi.Message{}, nil).Once()
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "Myydään käytetty iPhone 12"))
+	assert.Equal(t, "", session.listing.Body)
+
+	tg.On("Send", mock.AnythingOfType("tgbotapi.EditMessageTextConfig")).
+		Return(tgbotapi.Message{}, nil).Once()
+	tg.On("Request", mock.AnythingOfType("tgbotapi.CallbackConfig")).
+		Return(&tgbotapi.APIResponse{}, nil).Once()
+	tg.On("Send", makeMessage(userId, "Ilmoitusteksti?")).
+		Return(tgbotapi.Message{}, nil).Once()
+	bot.handleUpdate(tgbotapi.Update{
+		CallbackQuery: &tgbotapi.CallbackQuery{
+			ID:      "1",
+			From:    &tgbotapi.User{ID: userId},
+			Message: &tgbotapi.Message{MessageID: 1},
+			Data:    "Puhelimet",
+		},
+	})
+	tg.AssertExpectations(t)
+
+	assert.False(t, session.categoryUnconfirmed)
+	assert.Equal(t, "5012", session.listing.Category)
+}
+
+func TestHandleUpdate_CancelListingWithManyPhotos(t *testing.T) {
+	ts, userId, tg, bot, session := setup(t)
+	defer ts.Close()
+
+	session.startListing(&tori.Listing{
+		Subject:  "iPhone 12",
+		Category: "5012",
+		Type:     tori.ListingTypeSell,
+	})
+	for i := 0; i < confirmCancelMinPhotos; i++ {
+		id := fmt.Sprint(i)
+		session.photos = append(session.photos, tgbotapi.PhotoSize{FileID: id, FileUniqueID: id})
+	}
+
+	listingId := session.listingId
+	confirmMsg := makeConfirmCancelMessage("Ilmoituksessa on 5 kuvaa. Haluatko varmasti perua sen?", listingId)
+	confirmMsg.ChatID = userId
+	tg.On("Send", confirmMsg).Return(tgbotapi.Message{}, nil).Twice()
+	tg.On("Request", mock.AnythingOfType("tgbotapi.CallbackConfig")).
+		Return(&tgbotapi.APIResponse{}, nil).Twice()
+	tg.On("Request", mock.AnythingOfType("tgbotapi.DeleteMessageConfig")).
+		Return(&tgbotapi.APIResponse{}, nil).Twice()
+
+	makeCallback := func(data string) tgbotapi.Update {
+		return tgbotapi.Update{
+			CallbackQuery: &tgbotapi.CallbackQuery{
+				ID:      "1",
+				From:    &tgbotapi.User{ID: userId},
+				Message: &tgbotapi.Message{MessageID: 1},
+				Data:    data,
+			},
+		}
+	}
+
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/peru"))
+	tg.On("Send", makeMessage(userId, "Ok, ilmoitusta ei peruttu.")).
+		Return(tgbotapi.Message{}, nil).Once()
+	bot.handleUpdate(makeCallback("cancel:no:" + listingId))
+	assert.NotNil(t, session.listing)
+
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/peru"))
+	tg.On("Send", makeMessageWithRemoveReplyKeyboard(userId, "Ok! Jos peruit vahingossa, saat ilmoituksen takaisin komennolla /perista parin minuutin ajan.")).
+		Return(tgbotapi.Message{}, nil).Once()
+	bot.handleUpdate(makeCallback("cancel:yes:" + listingId))
+	assert.Nil(t, session.listing)
+	tg.AssertExpectations(t)
+
+	// Confirming again after a new listing was started doesn't cancel it
+	session.startListing(&tori.Listing{
+		Subject:  "iPad",
+		Category: "5031",
+		Type:     tori.ListingTypeSell,
+	})
+	tg.On("Request", mock.AnythingOfType("tgbotapi.CallbackConfig")).
+		Return(&tgbotapi.APIResponse{}, nil).Once()
+	tg.On("Request", mock.AnythingOfType("tgbotapi.DeleteMessageConfig")).
+		Return(&tgbotapi.APIResponse{}, nil).Once()
+	bot.handleUpdate(makeCallback("cancel:yes:" + listingId))
+	assert.NotNil(t, session.listing)
+	tg.AssertExpectations(t)
+}
+
+func TestHandleUpdate_CancelReadyListing(t *testing.T) {
+	ts, userId, tg, bot, session := setup(t)
+	defer ts.Close()
+
+	// No params in filters, so that nothing is missing from the listing
+	setCachedNewadFilters(tori.NewadFilters{})
+	defer clearCachedNewadFilters()
+
+	session.startListing(&tori.Listing{
+		Subject:  "iPhone 12",
+		Body:     "Myydään käytetty iPhone 12",
+		Category: "5012",
+		Type:     tori.ListingTypeSell,
+		Price:    50,
+	})
+
+	confirmMsg := makeConfirmCancelMessage("Ilmoitus on valmis lähetettäväksi. Haluatko varmasti perua sen?", session.listingId)
+	confirmMsg.ChatID = userId
+	tg.On("Send", confirmMsg).Return(tgbotapi.Message{}, nil).Once()
+
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/peru"))
+	tg.AssertExpectations(t)
+
+	assert.NotNil(t, session.listing)
+}
+
+func TestHandleUpdate_ConfirmCategoryByNumber(t *testing.T) {
+	ts, userId, tg, bot, session := setup(t)
+	defer ts.Close()
+
+	setCachedNewadFilters(tori.NewadFilters{})
+	defer clearCachedNewadFilters()
+
+	session.categories = []tori.Category{
+		{Code: "5012", Label: "Puhelimet"},
+		{Code: "5031", Label: "Tabletit"},
+	}
+	session.startListing(&tori.Listing{
+		Subject:  "iPad",
+		Category: "5012",
+		Type:     tori.ListingTypeSell,
+	})
+	session.categoryUnconfirmed = true
+
+	tg.On("Send", makeMessage(userId, "Vahvista ensin osasto valitsemalla se osastoviestin napeista tai vastaamalla osaston numerolla.")).
+		Return(tgbotapi.Message{}, nil).Once()
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "3"))
+	assert.True(t, session.categoryUnconfirmed)
+
+	tg.On("Send", makeMessage(userId, "*Osasto:* Tabletit")).
+		Return(tgbotapi.Message{}, nil).Once()
+	tg.On("Send", makeMessage(userId, "Ilmoitusteksti?")).
+		Return(tgbotapi.Message{}, nil).Once()
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "2"))
+	tg.AssertExpectations(t)
+
+	assert.False(t, session.categoryUnconfirmed)
+	assert.Equal(t, "5031", session.listing.Category)
+}
+
+func TestHandleUpdate_ChangeCategoryByNumber(t *testing.T) {
+	ts, userId, tg, bot, session := setup(t)
+	defer ts.Close()
+
+	setCachedNewadFilters(tori.NewadFilters{})
+	defer clearCachedNewadFilters()
+
+	session.categories = []tori.Category{
+		{Code: "5012", Label: "Puhelimet"},
+		{Code: "5031", Label: "Tabletit"},
+	}
+	session.startListing(&tori.Listing{
+		Subject:  "iPad",
+		Category: "5012",
+		Type:     tori.ListingTypeSell,
+	})
+	session.botCategoryMessageId = 2
+
+	replyToCategoryMessage := func(text string) tgbotapi.Update {
+		update := makeUpdateWithMessageText(userId, text)
+		update.Message.ReplyToMessage = &tgbotapi.Message{MessageID: 2}
+		return update
+	}
+
+	tg.On("Send", makeMessage(userId, "Osastoa numerolla 3 ei ole.")).
+		Return(tgbotapi.Message{}, nil).Once()
+	bot.handleUpdate(replyToCategoryMessage("3"))
+	assert.Equal(t, "5012", session.listing.Category)
+
+	tg.On("Send", makeMessage(userId, "*Osasto:* Tabletit")).
+		Return(tgbotapi.Message{}, nil).Once()
+	tg.On("Send", makeMessage(userId, "Ilmoitusteksti?")).
+		Return(tgbotapi.Message{}, nil).Once()
+	bot.handleUpdate(replyToCategoryMessage("2"))
+	tg.AssertExpectations(t)
+
+	assert.Equal(t, "5031", session.listing.Category)
+}
+
+func TestHandleUpdate_SwitchListingType(t *testing.T) {
+	ts, userId, tg, bot, session := setup(t)
+	defer ts.Close()
+
+	setCachedNewadFilters(tori.NewadFilters{})
+	defer clearCachedNewadFilters()
+
+	session.listing = &tori.Listing{
+		Subject:  "iPhone 12",
+		Body:     "Myydään käytetty iPhone 12",
+		Category: "5012",
+		Type:     tori.ListingTypeSell,
+		Price:    50,
+	}
+
+	tg.On("Send", makeMessage(userId, "*Ilmoituksen tyyppi:* Annetaan")).
+		Return(tgbotapi.Message{}, nil).Once()
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/vaihda"))
+	assert.Equal(t, tori.ListingTypeGive, session.listing.Type)
+	assert.Equal(t, tori.Price(0), session.listing.Price)
+
+	tg.On("Send", makeMessage(userId, "*Ilmoituksen tyyppi:* Myydään")).
+		Return(tgbotapi.Message{}, nil).Once()
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/vaihda"))
+	assert.Equal(t, tori.ListingTypeSell, session.listing.Type)
+	tg.AssertExpectations(t)
+}
+
+func TestHandleUpdate_SwitchListingTypeWithSettingsParams(t *testing.T) {
+	ts, userId, tg, bot, session := setup(t)
+	defer ts.Close()
+
+	// Like in tori, price is asked only when selling, and some fields depend
+	// on the type
+	setCachedNewadFilters(tori.NewadFilters{
+		Newad: tori.Newad{
+			ParamMap: tori.ParamMap{
+				"general_condition": {
+					SingleSelection: &tori.SingleSelection{Label: "Kunto", ParamKey: "general_condition"},
+				},
+				"delivery_options": {
+					SingleSelection: &tori.SingleSelection{Label: "Toimitustapa", ParamKey: "delivery_options"},
+				},
+				"price": {
+					Text: &tori.Text{Label: "Hinta", ParamKey: "price"},
+				},
+			},
+			SettingsParams: []tori.SettingsParam{
+				{
+					Keys: []string{"category", "type"},
+					Settings: []tori.Settings{
+						{
+							SettingsResult: []string{"type_skg", "general_condition", "zipcode", "price", "delivery_options"},
+							Values:         []string{"5012", "s"},
+						},
+						{
+							SettingsResult: []string{"type_skg", "general_condition", "zipcode"},
+							Values:         []string{"5012", "g"},
+						},
+					},
+				},
+			},
+		},
+	})
+	defer clearCachedNewadFilters()
+
+	session.listing = &tori.Listing{
+		Subject:  "iPhone 12",
+		Body:     "Myydään käytetty iPhone 12",
+		Category: "5012",
+		Type:     tori.ListingTypeSell,
+		Price:    50,
+		AdDetails: tori.AdDetails{
+			"general_condition": "new",
+			"delivery_options":  "shipping",
+		},
+	}
+
+	// Nothing is missing when giving away
+	tg.On("Send", makeMessage(userId, "*Ilmoituksen tyyppi:* Annetaan")).
+		Return(tgbotapi.Message{}, nil).Once()
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/vaihda"))
+	tg.AssertExpectations(t)
+	assert.Equal(t, tori.AdDetails{"general_condition": "new"}, session.listing.AdDetails)
+
+	tg.On("Send", makeMessage(userId, "*Ilmoituksen tyyppi:* Myydään")).
+		Return(tgbotapi.Message{}, nil).Once()
+	tg.On("Send", makeMessage(userId, "Hinta?")).
+		Return(tgbotapi.Message{}, nil).Once()
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/vaihda"))
+	tg.AssertExpectations(t)
+	assert.Equal(t, tori.ListingTypeSell, session.listing.Type)
+	assert.Equal(t, tori.Price(0), session.listing.Price)
+}
+
+func TestHandleUpdate_SwitchListingTypeBuy(t *testing.T) {
+	ts, userId, tg, bot, session := setup(t)
+	defer ts.Close()
+
+	setCachedNewadFilters(tori.NewadFilters{})
+	defer clearCachedNewadFilters()
+
+	session.listing = &tori.Listing{
+		Subject:  "iPhone 12",
+		Body:     "Ostetaan iPhone 12",
+		Category: "5012",
+		Type:     tori.ListingTypeBuy,
+		Price:    50,
+	}
+
+	tg.On("Send", makeMessage(userId, "Vain myytävän tai annettavan ilmoituksen tyyppiä voi vaihtaa.")).
+		Return(tgbotapi.Message{}, nil).Once()
+	bot.handleUpdate(makeUpdateWithMessageText(userId, "/vaihda"))
+	tg.AssertExpectations(t)
+
+	assert.Equal(t, tori.ListingTypeBuy, session.listing.Type)
+	assert.Equal(t, tori.Price(50), session.listing.Price)
+}
+
+func TestRestoreCancelledListingAfterWindow(t *testing.T) {
+	session := &UserSession{
+		cancelledListing: &cancelledListing{
+			saved:       SavedListing{Listing: tori.Listing{Subject: "iPhone 12"}},
+			cancelledAt: time.Now().Add(-restoreCancelledListingWindow - time.Second),
+		},
+	}
+
+	assert.False(t, session.restoreCancelledListing())
+	assert.Nil(t, session.listing)
+}
@@ -1,22 +1,65 @@
 package main
 
-import "github.com/raine/telegram-tori-bot/tori"
+import (
+	"sync"
 
+	"github.com/raine/telegram-tori-bot/tori"
+)
+
+// The cache is shared by all user sessions, and updates from different users
+// are handled concurrently, so access to it is guarded by a mutex.
 // TODO: TTL
-var cachedNewadFilters *tori.NewadFilters
+var (
+	cachedNewadFiltersMu sync.RWMutex
+	cachedNewadFilters   *tori.NewadFilters
+)
 
 func clearCachedNewadFilters() {
+	cachedNewadFiltersMu.Lock()
+	defer cachedNewadFiltersMu.Unlock()
 	cachedNewadFilters = nil
 }
 
 func setCachedNewadFilters(newadFilters tori.NewadFilters) {
+	cachedNewadFiltersMu.Lock()
+	defer cachedNewadFiltersMu.Unlock()
 	cachedNewadFilters = &newadFilters
 }
 
 func getCachedNewadFilters() (tori.NewadFilters, bool) {
+	cachedNewadFiltersMu.RLock()
+	defer cachedNewadFiltersMu.RUnlock()
 	if cachedNewadFilters == nil {
 		return tori.NewadFilters{}, false
 	} else {
 		return *cachedNewadFilters, true
 	}
 }
+
+// Category tree changes rarely, so it's fetched once and shared by all
+// sessions, like newad filters
+var (
+	cachedCategoriesMu sync.RWMutex
+	cachedCategories   *tori.Categories
+)
+
+func clearCachedCategories() {
+	cachedCategoriesMu.Lock()
+	defer cachedCategoriesMu.Unlock()
+	cachedCategories = nil
+}
+
+func setCachedCategories(categories tori.Categories) {
+	cachedCategoriesMu.Lock()
+	defer cachedCategoriesMu.Unlock()
+	cachedCategories = &categories
+}
+
+func getCachedCategories() (tori.Categories, bool) {
+	cachedCategoriesMu.RLock()
+	defer cachedCategoriesMu.RUnlock()
+	if cachedCategories == nil {
+		return tori.Categories{}, false
+	}
+	return *cachedCategories, true
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"errors"
 	"os"
+	"sync"
 	"testing"
 
 	"github.com/raine/telegram-tori-bot/tori"
@@ -26,3 +28,66 @@ func TestCachedNewadFilters(t *testing.T) {
 	assert.True(t, ok)
 	assert.NotEqual(t, tori.NewadFilters{}, result)
 }
+
+func TestCachedNewadFiltersConcurrentAccess(t *testing.T) {
+	newadFilters := tori.NewadFilters{
+		Newad: tori.Newad{
+			ParamMap: tori.ParamMap{
+				"general_condition": {
+					SingleSelection: &tori.SingleSelection{Label: "Kunto", ParamKey: "general_condition"},
+				},
+			},
+		},
+	}
+	defer clearCachedNewadFilters()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			setCachedNewadFilters(newadFilters)
+		}()
+		go func() {
+			defer wg.Done()
+			if result, ok := getCachedNewadFilters(); ok {
+				assert.Equal(t, newadFilters, result)
+			}
+		}()
+	}
+	wg.Wait()
+
+	result, ok := getCachedNewadFilters()
+	assert.True(t, ok)
+	assert.Equal(t, newadFilters, result)
+}
+
+func TestFetchCategoriesUsesCache(t *testing.T) {
+	clearCachedCategories()
+	defer clearCachedCategories()
+
+	var calls int
+	get := func() (tori.Categories, error) {
+		calls++
+		return tori.Categories{Categories: []tori.Category{{Code: "5000", Label: "ELEKTRONIIKKA"}}}, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		categories, err := fetchCategories(get)
+		assert.NoError(t, err)
+		assert.Equal(t, "ELEKTRONIIKKA", categories.GetCategoryLabel("5000"))
+	}
+	assert.Equal(t, 1, calls)
+}
+
+func TestFetchCategoriesDoesNotCacheError(t *testing.T) {
+	clearCachedCategories()
+	defer clearCachedCategories()
+
+	_, err := fetchCategories(func() (tori.Categories, error) {
+		return tori.Categories{}, errors.New("request failed")
+	})
+	assert.Error(t, err)
+	_, ok := getCachedCategories()
+	assert.False(t, ok)
+}
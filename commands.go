@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// commands are the canonical commands the bot understands
+var commands = []string{
+	"/start",
+	"/peru",
+	"/perista",
+	"/laheta",
+	"/tarkista",
+	"/poistakuvat",
+	"/kuvat",
+	"/vaihda",
+	"/tuojson",
+	"/unohda",
+	"/lisaa-alias",
+	"/osasto",
+	"/etsiosasto",
+	"/varmuuskopio",
+	"/tuoasetukset",
+	"/ohje",
+}
+
+// defaultCommandAliases maps alternative spellings and English equivalents to
+// canonical commands. They are used unless user config has its own aliases.
+// Keys are compared after normalizeCommand.
+var defaultCommandAliases = map[string]string{
+	"/send":     "/laheta",
+	"/cancel":   "/peru",
+	"/check":    "/tarkista",
+	"/status":   "/tarkista",
+	"/category": "/osasto",
+	"/forget":   "/unohda",
+	"/help":     "/ohje",
+}
+
+type commandHelp struct {
+	command     string
+	description string
+	// listingOnly commands are only shown when a listing is in progress
+	listingOnly bool
+}
+
+// commandHelps are the commands shown by /ohje, in the order they are shown
+var commandHelps = []commandHelp{
+	{command: "/laheta", description: "Lähetä ilmoitus", listingOnly: true},
+	{command: "/tarkista", description: "Tarkista, onko ilmoitus valmis lähetettäväksi", listingOnly: true},
+	{command: "/peru", description: "Peru ilmoituksen teko", listingOnly: true},
+	{command: "/osasto", description: "Valitse osasto aliaksella tai selaamalla", listingOnly: true},
+	{command: "/etsiosasto", description: "Etsi osastoa hakusanoilla", listingOnly: true},
+	{command: "/vaihda", description: "Vaihda myydäänkö vai annetaanko", listingOnly: true},
+	{command: "/kuvat", description: "Näytä kuvat, poista niitä tai vaihda pääkuva", listingOnly: true},
+	{command: "/poistakuvat", description: "Poista kaikki kuvat", listingOnly: true},
+	{command: "/unohda", description: "Unohda kentän arvo, esim. /unohda hinta", listingOnly: true},
+	{command: "/perista", description: "Palauta juuri peruttu ilmoitus"},
+	{command: "/tuojson", description: "Tuo ilmoitus vastaamalla archive.json-tiedostoon"},
+	{command: "/lisaa-alias", description: "Lisää osastolle alias"},
+	{command: "/varmuuskopio", description: "Varmuuskopioi asetukset"},
+	{command: "/tuoasetukset", description: "Tuo asetukset vastaamalla varmuuskopioon"},
+}
+
+// makeHelpText lists the commands that are useful at the moment. Commands
+// for a listing in progress are left out when there is none.
+func makeHelpText(hasListing bool) string {
+	lines := make([]string, 0, len(commandHelps)+1)
+	if !hasListing {
+		lines = append(lines, startText+".", "")
+	}
+	for _, c := range commandHelps {
+		if c.listingOnly && !hasListing {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s - %s", c.command, c.description))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// maxCommandSuggestionDistance is the largest edit distance between an
+// unknown command and a known one for which a suggestion is given
+const maxCommandSuggestionDistance = 2
+
+var diacriticsReplacer = strings.NewReplacer("ä", "a", "ö", "o", "å", "a")
+
+// normalizeCommand lowercases the command, removes Finnish diacritics and
+// the @botname suffix Telegram adds to commands in group chats
+func normalizeCommand(command string) string {
+	command = strings.ToLower(command)
+	if i := strings.Index(command, "@"); i != -1 {
+		command = command[:i]
+	}
+	return diacriticsReplacer.Replace(command)
+}
+
+// resolveCommand returns the canonical command for s, or an empty string if s
+// is not a known command or one of aliases
+func resolveCommand(s string, aliases map[string]string) string {
+	command := normalizeCommand(s)
+	if isCommand(command) {
+		return command
+	}
+	if c, ok := aliases[command]; ok {
+		return c
+	}
+	return ""
+}
+
+func isCommand(command string) bool {
+	for _, c := range commands {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeCommandAliases normalizes command aliases from user config the same
+// way as commands, so that they can be looked up by a normalized command.
+// Aliases must point to canonical commands.
+func normalizeCommandAliases(aliases map[string]string) (map[string]string, error) {
+	normalized := make(map[string]string, len(aliases))
+	for alias, command := range aliases {
+		command = normalizeCommand(command)
+		if !isCommand(command) {
+			return nil, errors.Errorf("command alias %s is for unknown command %s", alias, command)
+		}
+		normalized[normalizeCommand(alias)] = command
+	}
+	return normalized, nil
+}
+
+// suggestCommand returns the known command closest to an unknown command, if
+// it is close enough to be a typo
+func suggestCommand(s string) string {
+	command := normalizeCommand(s)
+	var suggestion string
+	bestDistance := maxCommandSuggestionDistance + 1
+	for _, c := range commands {
+		if d := levenshteinDistance(command, c); d < bestDistance {
+			bestDistance = d
+			suggestion = c
+		}
+	}
+	return suggestion
+}
+
+func minInt(first int, rest ...int) int {
+	m := first
+	for _, n := range rest {
+		if n < m {
+			m = n
+		}
+	}
+	return m
+}
+
+func levenshteinDistance(a string, b string) int {
+	ar, br := []rune(a), []rune(b)
+	prev := make([]int, len(br)+1)
+	curr := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ar); i++ {
+		curr[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(br)]
+}
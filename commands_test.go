@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveCommand(t *testing.T) {
+	tests := map[string]string{
+		"/laheta":        "/laheta",
+		"/lähetä":        "/laheta",
+		"/LAHETA":        "/laheta",
+		"/laheta@my_bot": "/laheta",
+		"/send":          "/laheta",
+		"/cancel":        "/peru",
+		"/status":        "/tarkista",
+		"/lahta":         "",
+		"/foo":           "",
+	}
+
+	for input, want := range tests {
+		t.Run(input, func(t *testing.T) {
+			assert.Equal(t, want, resolveCommand(input, defaultCommandAliases))
+		})
+	}
+}
+
+func TestResolveCommandWithConfiguredAliases(t *testing.T) {
+	aliases, err := normalizeCommandAliases(map[string]string{
+		"/L":     "/lähetä",
+		"/uusi":  "/peru",
+		"/kuvia": "/kuvat",
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "/laheta", resolveCommand("/l", aliases))
+	assert.Equal(t, "/peru", resolveCommand("/uusi", aliases))
+	// Default aliases are replaced
+	assert.Equal(t, "", resolveCommand("/send", aliases))
+	// Commands work without aliases
+	assert.Equal(t, "/tarkista", resolveCommand("/tarkista", aliases))
+}
+
+func TestNormalizeCommandAliasesWithUnknownCommand(t *testing.T) {
+	_, err := normalizeCommandAliases(map[string]string{"/l": "/lahetys"})
+	assert.EqualError(t, err, "command alias /l is for unknown command /lahetys")
+}
+
+func TestSuggestCommand(t *testing.T) {
+	tests := map[string]string{
+		"/lahta":      "/laheta",
+		"/lahetää":    "/laheta",
+		"/poistakuva": "/poistakuvat",
+		"/banaani":    "",
+	}
+
+	for input, want := range tests {
+		t.Run(input, func(t *testing.T) {
+			assert.Equal(t, want, suggestCommand(input))
+		})
+	}
+}
+
+func TestMakeHelpText(t *testing.T) {
+	withoutListing := makeHelpText(false)
+	assert.Contains(t, withoutListing, "/perista - Palauta juuri peruttu ilmoitus")
+	assert.NotContains(t, withoutListing, "/laheta")
+
+	withListing := makeHelpText(true)
+	assert.Contains(t, withListing, "/laheta - Lähetä ilmoitus")
+	assert.Contains(t, withListing, "/perista")
+}
+
+func TestDefaultCommandAliasesAreValid(t *testing.T) {
+	aliases, err := normalizeCommandAliases(defaultCommandAliases)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultCommandAliases, aliases)
+}
+
+func TestCommandHelpsAreKnownCommands(t *testing.T) {
+	for _, c := range commandHelps {
+		assert.Equal(t, c.command, resolveCommand(c.command, nil))
+	}
+}
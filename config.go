@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Config is the configuration of the bot read from environment variables
+type Config struct {
+	BotToken       string
+	UserConfigPath string
+	// ListingStoreDir is empty if listings in progress are not saved
+	ListingStoreDir string
+	SendRetryDelay  time.Duration
+	DryRun          bool
+	// HealthAddr is empty if health checks are not served
+	HealthAddr string
+}
+
+// loadConfig reads the config with lookupEnv, usually os.LookupEnv. All
+// missing and invalid variables are reported at once, so that they can be
+// fixed without trying to start the bot again after each one.
+func loadConfig(lookupEnv func(key string) (string, bool)) (Config, error) {
+	cfg := Config{SendRetryDelay: defaultSendRetryDelay}
+	var problems []string
+
+	required := func(key string) string {
+		v, ok := lookupEnv(key)
+		if !ok || v == "" {
+			problems = append(problems, key+" is not set")
+		}
+		return v
+	}
+
+	cfg.BotToken = required("BOT_TOKEN")
+	cfg.UserConfigPath = required("USER_CONFIG_PATH")
+	cfg.ListingStoreDir, _ = lookupEnv("LISTING_STORE_DIR")
+	cfg.HealthAddr, _ = lookupEnv("HEALTH_ADDR")
+
+	if v, ok := lookupEnv("SEND_RETRY_DELAY"); ok {
+		delay, err := time.ParseDuration(v)
+		if err != nil {
+			problems = append(problems, "SEND_RETRY_DELAY is not a valid duration: "+v)
+		}
+		cfg.SendRetryDelay = delay
+	}
+	if v, ok := lookupEnv("TORI_DRY_RUN"); ok {
+		dryRun, err := strconv.ParseBool(v)
+		if err != nil {
+			problems = append(problems, "TORI_DRY_RUN is not a valid boolean: "+v)
+		}
+		cfg.DryRun = dryRun
+	}
+
+	if len(problems) > 0 {
+		return cfg, errors.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return cfg, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeLookupEnv(env map[string]string) func(key string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := loadConfig(makeLookupEnv(map[string]string{
+		"BOT_TOKEN":        "abc",
+		"USER_CONFIG_PATH": "user_config.toml",
+		"SEND_RETRY_DELAY": "5s",
+		"TORI_DRY_RUN":     "true",
+	}))
+
+	assert.NoError(t, err)
+	assert.Equal(t, Config{
+		BotToken:       "abc",
+		UserConfigPath: "user_config.toml",
+		SendRetryDelay: 5 * time.Second,
+		DryRun:         true,
+	}, cfg)
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := loadConfig(makeLookupEnv(map[string]string{
+		"BOT_TOKEN":        "abc",
+		"USER_CONFIG_PATH": "user_config.toml",
+	}))
+
+	assert.NoError(t, err)
+	assert.Equal(t, defaultSendRetryDelay, cfg.SendRetryDelay)
+	assert.False(t, cfg.DryRun)
+}
+
+func TestLoadConfigReportsAllProblems(t *testing.T) {
+	_, err := loadConfig(makeLookupEnv(map[string]string{
+		"SEND_RETRY_DELAY": "soon",
+	}))
+
+	assert.EqualError(t, err, "invalid config: BOT_TOKEN is not set; USER_CONFIG_PATH is not set; SEND_RETRY_DELAY is not a valid duration: soon")
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// newHealthHandler serves /healthz, which responds whenever the process is
+// up, and /readyz, which responds with 503 if ready returns an error
+func newHealthHandler(ready func() error) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := ready(); err != nil {
+			log.Error().Err(err).Msg("readiness check failed")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, err.Error())
+			return
+		}
+		io.WriteString(w, "ok")
+	})
+	return mux
+}
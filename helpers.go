@@ -1,43 +1,128 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/raine/telegram-tori-bot/tori"
-	"github.com/rs/zerolog/log"
-	"golang.org/x/sync/errgroup"
+	"github.com/rs/zerolog"
 )
 
-// uploadListingPhotos uploads given tgbotapi.PhotoSizes to tori
+type PhotoUploadError struct {
+	Total  int
+	Failed []int
+}
+
+func (e *PhotoUploadError) Error() string {
+	return fmt.Sprintf("failed to upload %d of %d photos", len(e.Failed), e.Total)
+}
+
+// appendUniquePhotos appends the photos that are not already in photos, and
+// returns the number of skipped duplicates. Photos are compared by the hashes
+// of their contents, because a photo that is sent again, e.g. from another
+// chat, is a new file with a different FileUniqueID. Photos without a hash are
+// compared by FileUniqueID.
+func appendUniquePhotos(photos []tgbotapi.PhotoSize, newPhotos []tgbotapi.PhotoSize, hashes map[string]string) ([]tgbotapi.PhotoSize, int) {
+	key := func(p tgbotapi.PhotoSize) string {
+		if hash, ok := hashes[p.FileUniqueID]; ok {
+			return hash
+		}
+		return p.FileUniqueID
+	}
+
+	seen := make(map[string]bool, len(photos)+len(newPhotos))
+	for _, p := range photos {
+		seen[key(p)] = true
+	}
+
+	var skipped int
+	for _, p := range newPhotos {
+		if seen[key(p)] {
+			skipped++
+			continue
+		}
+		seen[key(p)] = true
+		photos = append(photos, p)
+	}
+	return photos, skipped
+}
+
+// hashPhotos downloads photos from telegram and returns SHA-256 hashes of
+// their contents by FileUniqueID. Photos that can't be downloaded are left
+// out, so that they are compared by FileUniqueID only.
+func hashPhotos(
+	logger *zerolog.Logger,
+	getFileDirectURL func(fileId string) (string, error),
+	photos []tgbotapi.PhotoSize,
+) map[string]string {
+	hashes := make(map[string]string, len(photos))
+	for _, p := range photos {
+		photoBytes, err := downloadFileID(logger, getFileDirectURL, p.FileID)
+		if err != nil {
+			logger.Error().Err(err).Str("fileUniqueId", p.FileUniqueID).Msg("failed to download photo for hashing")
+			continue
+		}
+		sum := sha256.Sum256(photoBytes)
+		hashes[p.FileUniqueID] = hex.EncodeToString(sum[:])
+	}
+	return hashes
+}
+
+// uploadListingPhotos uploads given tgbotapi.PhotoSizes to tori. An upload
+// that fails with a transient error is made again after retryDelay; at worst
+// tori ends up with an unused copy of the photo. If some of the uploads still
+// fail, the rest are uploaded and a PhotoUploadError with the indexes of
+// failed photos is returned.
 func uploadListingPhotos(
+	logger *zerolog.Logger,
+	retryDelay time.Duration,
 	getFileDirectURL func(fileId string) (string, error),
 	toriUploadMedia func(data []byte) (tori.Media, error),
 	photoSizes []tgbotapi.PhotoSize,
 ) ([]tori.Media, error) {
 	medias := make([]tori.Media, len(photoSizes))
-	g := new(errgroup.Group)
+	errs := make([]error, len(photoSizes))
+	var wg sync.WaitGroup
 	for i := range photoSizes {
 		i := i
-		g.Go(func() error {
-			photo, err := downloadFileID(getFileDirectURL, photoSizes[i].FileID)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			photo, err := downloadFileID(logger, getFileDirectURL, photoSizes[i].FileID)
 			if err != nil {
-				log.Error().Err(err).Msg("failed to download photo size")
-				return err
+				logger.Error().Err(err).Int("photo", i).Msg("failed to download photo size")
+				errs[i] = err
+				return
 			}
 
-			m, err := toriUploadMedia(photo)
-			if err != nil {
-				log.Error().Err(err).Msg("failed to upload photo to tori")
+			var m tori.Media
+			err = retryOnError(logger, retryDelay, isTransientError, func() error {
+				m, err = toriUploadMedia(photo)
 				return err
+			})
+			if err != nil {
+				withResponseError(logger.Error(), err).Err(err).Int("photo", i).Msg("failed to upload photo to tori")
+				errs[i] = err
+				return
 			}
 
 			medias[i] = m
-			return nil
-		})
+		}()
 	}
+	wg.Wait()
 
-	err := g.Wait()
-	if err != nil {
-		return medias, err
+	var failed []int
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, i)
+		}
+	}
+	if len(failed) > 0 {
+		return medias, &PhotoUploadError{Total: len(photoSizes), Failed: failed}
 	}
 	return medias, nil
 }
@@ -9,6 +9,7 @@ import (
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/raine/telegram-tori-bot/tori"
+	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -42,7 +43,7 @@ func TestUploadListingPhotos(t *testing.T) {
 		Auth:    "foo",
 	})
 
-	got, _ := uploadListingPhotos(getFileDirectUrl, client.UploadMedia, photoSizes)
+	got, _ := uploadListingPhotos(&log.Logger, 0, getFileDirectUrl, client.UploadMedia, photoSizes)
 	want := []tori.Media{
 		{Id: "1", Url: "https://images.tori.fi/api/v1/imagestori/images/1.jpg?rule=images"},
 		{Id: "3", Url: "https://images.tori.fi/api/v1/imagestori/images/3.jpg?rule=images"},
@@ -50,3 +51,113 @@ func TestUploadListingPhotos(t *testing.T) {
 	}
 	assert.ElementsMatch(t, want, got)
 }
+
+func TestUploadListingPhotosPartialFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a.jpg", "/c.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write([]byte("123"))
+		case "/b.jpg":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/v2.2/media":
+			w.Header().Set("Content-Type", "plain/text")
+			io.WriteString(w, `{"image":{"url":"","id":"1"}}`)
+		}
+	}))
+	defer ts.Close()
+
+	getFileDirectUrl := func(fileId string) (string, error) {
+		return fmt.Sprintf("%s/%s.jpg", ts.URL, fileId), nil
+	}
+
+	photoSizes := []tgbotapi.PhotoSize{
+		{FileID: "a", FileUniqueID: "1", Width: 371, Height: 495, FileSize: 28548},
+		{FileID: "b", FileUniqueID: "2", Width: 371, Height: 495, FileSize: 28548},
+		{FileID: "c", FileUniqueID: "3", Width: 371, Height: 495, FileSize: 28548},
+	}
+
+	client := tori.NewClient(tori.ClientOpts{
+		BaseURL: ts.URL,
+		Auth:    "foo",
+	})
+
+	_, err := uploadListingPhotos(&log.Logger, 0, getFileDirectUrl, client.UploadMedia, photoSizes)
+	assert.Equal(t, &PhotoUploadError{Total: 3, Failed: []int{1}}, err)
+	assert.EqualError(t, err, "failed to upload 1 of 3 photos")
+}
+
+func TestAppendUniquePhotos(t *testing.T) {
+	photos := []tgbotapi.PhotoSize{
+		{FileID: "a1", FileUniqueID: "a"},
+	}
+	newPhotos := []tgbotapi.PhotoSize{
+		{FileID: "b1", FileUniqueID: "b"},
+		{FileID: "a2", FileUniqueID: "a"},
+		{FileID: "b2", FileUniqueID: "b"},
+		{FileID: "c1", FileUniqueID: "c"},
+	}
+
+	got, skipped := appendUniquePhotos(photos, newPhotos, nil)
+	assert.Equal(t, []tgbotapi.PhotoSize{
+		{FileID: "a1", FileUniqueID: "a"},
+		{FileID: "b1", FileUniqueID: "b"},
+		{FileID: "c1", FileUniqueID: "c"},
+	}, got)
+	assert.Equal(t, 2, skipped)
+}
+
+func TestAppendUniquePhotosWithSameContent(t *testing.T) {
+	photos := []tgbotapi.PhotoSize{
+		{FileID: "a1", FileUniqueID: "a"},
+	}
+	// The same photo sent again from another chat has a different
+	// FileUniqueID
+	newPhotos := []tgbotapi.PhotoSize{
+		{FileID: "b1", FileUniqueID: "b"},
+		{FileID: "c1", FileUniqueID: "c"},
+	}
+	hashes := map[string]string{
+		"a": "hash1",
+		"b": "hash1",
+		"c": "hash2",
+	}
+
+	got, skipped := appendUniquePhotos(photos, newPhotos, hashes)
+	assert.Equal(t, []tgbotapi.PhotoSize{
+		{FileID: "a1", FileUniqueID: "a"},
+		{FileID: "c1", FileUniqueID: "c"},
+	}, got)
+	assert.Equal(t, 1, skipped)
+}
+
+func TestHashPhotos(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a.jpg", "/b.jpg":
+			w.Write([]byte("123"))
+		case "/c.jpg":
+			w.Write([]byte("456"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	getFileDirectUrl := func(fileId string) (string, error) {
+		return fmt.Sprintf("%s/%s.jpg", ts.URL, fileId), nil
+	}
+	photos := []tgbotapi.PhotoSize{
+		{FileID: "a", FileUniqueID: "1"},
+		{FileID: "b", FileUniqueID: "2"},
+		{FileID: "c", FileUniqueID: "3"},
+		{FileID: "d", FileUniqueID: "4"},
+	}
+
+	hashes := hashPhotos(&log.Logger, getFileDirectUrl, photos)
+	assert.Len(t, hashes, 3)
+	assert.Equal(t, hashes["1"], hashes["2"])
+	assert.NotEqual(t, hashes["1"], hashes["3"])
+	// Photo that can't be downloaded is compared by FileUniqueID
+	assert.NotContains(t, hashes, "4")
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/raine/telegram-tori-bot/tori"
+	"golang.org/x/exp/slices"
 )
 
 type NoLabelFoundError struct {
@@ -18,6 +19,10 @@ func (e *NoLabelFoundError) Error() string {
 	return fmt.Sprintf("could not find value for label %s with field %s", e.Label, e.Field)
 }
 
+// maxLabelDistance is the largest edit distance between a typed reply and a
+// value's label for which the value is still selected
+const maxLabelDistance = 2
+
 // findParamValueForLabel tries to find a value for a given human friendly
 // label. For example if you have general_condition param, and the label
 // "Uusi", the value would be "new".
@@ -29,6 +34,9 @@ func findParamValueForLabel(param tori.Param, label string) (string, error) {
 				return v.Value, nil
 			}
 		}
+		if v, ok := findClosestValue(param.SingleSelection.ValuesList, label); ok {
+			return v.Value, nil
+		}
 
 		return "", &NoLabelFoundError{Label: label, Field: param.SingleSelection.ParamKey}
 	default:
@@ -36,12 +44,123 @@ func findParamValueForLabel(param tori.Param, label string) (string, error) {
 	}
 }
 
+// findClosestValue finds the value with a label closest to the given one, to
+// tolerate typos when reply keyboard is not used. Short labels allow fewer
+// typos, and if two values are equally close, neither is selected.
+func findClosestValue(values []tori.Value, label string) (tori.Value, bool) {
+	label = diacriticsReplacer.Replace(strings.ToLower(strings.TrimSpace(label)))
+	var closest tori.Value
+	closestDistance := -1
+	ambiguous := false
+	for _, v := range values {
+		vLabel := diacriticsReplacer.Replace(strings.ToLower(v.Label))
+		distance := levenshteinDistance(label, vLabel)
+		if distance > minInt(maxLabelDistance, len([]rune(vLabel))/4) {
+			continue
+		}
+		switch {
+		case closestDistance == -1 || distance < closestDistance:
+			closest, closestDistance, ambiguous = v, distance, false
+		case distance == closestDistance:
+			ambiguous = true
+		}
+	}
+	return closest, closestDistance != -1 && !ambiguous
+}
+
+// getLabelForParamValue returns the label of a single selection param's
+// value, or an empty string if there is no such value
+func getLabelForParamValue(param tori.Param, value any) string {
+	if param.SingleSelection == nil {
+		return ""
+	}
+	for _, v := range param.SingleSelection.ValuesList {
+		if v.Value == value {
+			return v.Label
+		}
+	}
+	return ""
+}
+
 func initEmptyAdDetails(listing *tori.Listing) {
 	if listing.AdDetails == nil {
 		listing.AdDetails = tori.AdDetails{}
 	}
 }
 
+// restoreAdDetails returns the values from previous AdDetails of fields that
+// are asked for the listing too, e.g. after listing's category has changed.
+// Values are restored in the order fields are asked, because which fields are
+// asked can depend on the values of previous fields.
+func restoreAdDetails(paramMap tori.ParamMap, settingsParams []tori.SettingsParam, listing tori.Listing, previous tori.AdDetails) tori.AdDetails {
+	listing.AdDetails = nil
+	for {
+		field := getMissingListingField(paramMap, settingsParams, listing)
+		if field == "" || field == "body" {
+			break
+		}
+		// Price is not in AdDetails, but fields after it can be restored. Only
+		// AdDetails is returned, so setting the price here changes nothing.
+		if field == "price" {
+			listing.Price = 1
+			continue
+		}
+		paramKey := getParamKey(paramMap, field)
+		value, ok := restoreParamValue(paramMap, paramMap[field], previous[paramKey])
+		if !ok {
+			break
+		}
+		initEmptyAdDetails(&listing)
+		listing.AdDetails[paramKey] = value
+	}
+	return listing.AdDetails
+}
+
+// restoreParamValue returns the previous value of a param if the param
+// accepts it. A single selection value that is not one of the param's values
+// is matched by its label, since the same choice, such as a condition, can
+// have a different value in another field.
+func restoreParamValue(paramMap tori.ParamMap, param tori.Param, previous any) (any, bool) {
+	switch {
+	case param.SingleSelection != nil:
+		value, ok := previous.(string)
+		if !ok {
+			return nil, false
+		}
+		// Values of some params are not listed, so they can't be checked
+		if len(param.SingleSelection.ValuesList) == 0 || getLabelForParamValue(param, value) != "" {
+			return value, true
+		}
+		for _, p := range paramMap {
+			if p.SingleSelection == nil || p.SingleSelection.ParamKey != param.SingleSelection.ParamKey {
+				continue
+			}
+			for _, v := range param.SingleSelection.ValuesList {
+				if label := getLabelForParamValue(p, value); label != "" && strings.EqualFold(v.Label, label) {
+					return v.Value, true
+				}
+			}
+		}
+		return nil, false
+	case param.MultiSelection != nil:
+		values, ok := previous.([]string)
+		if !ok {
+			return nil, false
+		}
+		for _, value := range values {
+			if slices.IndexFunc(param.MultiSelection.ValuesList, func(v tori.Value) bool { return v.Value == value }) == -1 {
+				return nil, false
+			}
+		}
+		return values, true
+	case param.Text != nil:
+		value, ok := previous.(string)
+		return value, ok
+	default:
+		return nil, false
+	}
+}
+
 func setListingFieldFromMessage(paramMap tori.ParamMap, listing tori.Listing, field string, message string) (tori.Listing, error) {
 	switch field {
 	case "body":
@@ -87,14 +206,17 @@ func setListingFieldFromMessage(paramMap tori.ParamMap, listing tori.Listing, fi
 	return listing, nil
 }
 
-func newListingFromMessage(message string) tori.Listing {
+// newListingFromMessage creates a listing from subject message. The listing
+// type can be given by prefixing the subject with "myydään" or "annetaan",
+// and defaultType is used otherwise.
+func newListingFromMessage(message string, defaultType tori.ListingType) tori.Listing {
 	var listingType tori.ListingType
 	re := regexp.MustCompile(`(?i)(myydään|annetaan)\s`)
 	m := re.FindStringSubmatch(strings.ToLower(message))
 
 	switch {
 	case m == nil:
-		listingType = tori.ListingTypeSell
+		listingType = defaultType
 	case m[1] == "myydään":
 		listingType = tori.ListingTypeSell
 	case m[1] == "annetaan":
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/pkg/errors"
+	"github.com/raine/telegram-tori-bot/tori"
+)
+
+// SavedListing is the state of a listing in progress that is needed to
+// continue creating it after the bot is restarted
+type SavedListing struct {
+	ListingId  string               `json:"listingId"`
+	Listing    tori.Listing         `json:"listing"`
+	Photos     []tgbotapi.PhotoSize `json:"photos"`
+	Categories []tori.Category      `json:"categories"`
+	// Message ids of the subject and body, so that editing them still
+	// updates the listing
+	UserSubjectMessageId int `json:"userSubjectMessageId,omitempty"`
+	UserBodyMessageId    int `json:"userBodyMessageId,omitempty"`
+	BotSubjectMessageId  int `json:"botSubjectMessageId,omitempty"`
+	BotBodyMessageId     int `json:"botBodyMessageId,omitempty"`
+	// Message id of the category message, so that replying to it with a
+	// number still changes the category
+	BotCategoryMessageId int  `json:"botCategoryMessageId,omitempty"`
+	CategoryUnconfirmed  bool `json:"categoryUnconfirmed,omitempty"`
+	// EmptyAdDetails are the keys of multi value AdDetails that are set but
+	// empty. They are dropped when AdDetails is marshaled, but are needed to
+	// know that the field has been asked.
+	EmptyAdDetails []string `json:"emptyAdDetails,omitempty"`
+}
+
+// ListingStore saves listings in progress as JSON files, one per user, in a
+// directory
+type ListingStore struct {
+	dir string
+}
+
+func NewListingStore(dir string) (*ListingStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errors.Wrap(err, "could not create listing store directory")
+	}
+	return &ListingStore{dir: dir}, nil
+}
+
+func (s *ListingStore) path(userId int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%d.json", userId))
+}
+
+func (s *ListingStore) Save(userId int64, saved SavedListing) error {
+	saved.EmptyAdDetails = nil
+	for k, v := range saved.Listing.AdDetails {
+		if v, ok := v.([]string); ok && len(v) == 0 {
+			saved.EmptyAdDetails = append(saved.EmptyAdDetails, k)
+		}
+	}
+
+	b, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that a crash while writing does not
+	// leave a corrupted file behind
+	tmpPath := s.path(userId) + ".tmp"
+	if err := os.WriteFile(tmpPath, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path(userId))
+}
+
+// Load returns the saved listing of user, or nil if there is none
+func (s *ListingStore) Load(userId int64) (*SavedListing, error) {
+	b, err := os.ReadFile(s.path(userId))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var saved SavedListing
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal saved listing of user %d", userId)
+	}
+	for _, k := range saved.EmptyAdDetails {
+		initEmptyAdDetails(&saved.Listing)
+		saved.Listing.AdDetails[k] = []string{}
+	}
+	saved.EmptyAdDetails = nil
+	return &saved, nil
+}
+
+func (s *ListingStore) Delete(userId int64) error {
+	err := os.Remove(s.path(userId))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/raine/telegram-tori-bot/tori"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListingStore(t *testing.T) {
+	store, err := NewListingStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := store.Load(1)
+	assert.NoError(t, err)
+	assert.Nil(t, saved)
+
+	want := SavedListing{
+		ListingId: "abc",
+		Listing: tori.Listing{
+			Subject:  "iPhone 12",
+			Body:     "Myydään käytetty iPhone 12",
+			Category: "5012",
+			Type:     tori.ListingTypeSell,
+			Price:    50,
+			AdDetails: tori.AdDetails{
+				"general_condition": "new",
+				// Empty multi values are not marshaled, but must be restored
+				"delivery_options": []string{},
+			},
+		},
+		Photos: []tgbotapi.PhotoSize{
+			{FileID: "1", FileUniqueID: "1", Width: 371, Height: 495, FileSize: 28548},
+		},
+		Categories: []tori.Category{
+			{Code: "5012", Label: "Puhelimet"},
+		},
+		UserSubjectMessageId: 1,
+		UserBodyMessageId:    3,
+		BotSubjectMessageId:  2,
+		BotBodyMessageId:     4,
+		BotCategoryMessageId: 5,
+		CategoryUnconfirmed:  true,
+	}
+	assert.NoError(t, store.Save(1, want))
+
+	saved, err = store.Load(1)
+	assert.NoError(t, err)
+	assert.Equal(t, &want, saved)
+
+	assert.NoError(t, store.Delete(1))
+	saved, err = store.Load(1)
+	assert.NoError(t, err)
+	assert.Nil(t, saved)
+
+	// Deleting a listing that does not exist is not an error
+	assert.NoError(t, store.Delete(1))
+}
+
+func TestNewUserSessionRestoresSavedListing(t *testing.T) {
+	store, err := NewListingStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing := tori.Listing{
+		Subject:   "iPhone 12",
+		Category:  "5012",
+		Type:      tori.ListingTypeSell,
+		AdDetails: tori.AdDetails{},
+	}
+	err = store.Save(1, SavedListing{
+		ListingId:            "abc",
+		Listing:              listing,
+		UserSubjectMessageId: 1,
+		BotSubjectMessageId:  2,
+		CategoryUnconfirmed:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bot := NewBot(new(botApiMock), userConfigMap, "")
+	bot.listingStore = store
+	session, err := bot.state.getUserSession(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, &listing, session.listing)
+	assert.Equal(t, "abc", session.listingId)
+	assert.Equal(t, 1, session.userSubjectMessageId)
+	assert.Equal(t, 2, session.botSubjectMessageId)
+	assert.True(t, session.categoryUnconfirmed)
+}
@@ -127,13 +127,177 @@ func TestFindValueForLabel(t *testing.T) {
 	}
 }
 
+func TestFindClosestValue(t *testing.T) {
+	values := []tori.Value{
+		{Label: "Uusi", Value: "new"},
+		{Label: "Erinomainen", Value: "excellent"},
+		{Label: "Hyvä", Value: "good"},
+		{Label: "Tyydyttävä", Value: "fair"},
+	}
+
+	tests := map[string]struct {
+		label  string
+		want   string
+		wantOk bool
+	}{
+		"typo":                     {label: "erinomanen", want: "excellent", wantOk: true},
+		"missing diacritics":       {label: "tyydyttava", want: "fair", wantOk: true},
+		"too many typos":           {label: "erimonaanen", wantOk: false},
+		"typo in short label":      {label: "Uusu", want: "new", wantOk: true},
+		"two typos in short label": {label: "Usuu", wantOk: false},
+		"unrelated":                {label: "banaani", wantOk: false},
+		"diacritics short label":   {label: "hyva", want: "good", wantOk: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, ok := findClosestValue(values, tc.label)
+			assert.Equal(t, tc.wantOk, ok)
+			if tc.wantOk {
+				assert.Equal(t, tc.want, got.Value)
+			}
+		})
+	}
+}
+
+func TestFindClosestValueAmbiguous(t *testing.T) {
+	values := []tori.Value{
+		{Label: "Musta kuori", Value: "1"},
+		{Label: "Musta kuoro", Value: "2"},
+	}
+	_, ok := findClosestValue(values, "musta kuora")
+	assert.False(t, ok)
+}
+
+func TestRestoreAdDetails(t *testing.T) {
+	paramMap := tori.ParamMap{
+		"general_condition": {
+			SingleSelection: &tori.SingleSelection{
+				Label:      "Kunto",
+				ParamKey:   "general_condition",
+				ValuesList: []tori.Value{{Label: "Uusi", Value: "new"}, {Label: "Hyvä", Value: "good"}},
+			},
+		},
+		// Same choices with different values
+		"clothing_condition": {
+			SingleSelection: &tori.SingleSelection{
+				Label:      "Kunto",
+				ParamKey:   "general_condition",
+				ValuesList: []tori.Value{{Label: "Uusi", Value: "1"}, {Label: "Hyvä", Value: "2"}},
+			},
+		},
+		"cell_phone": {
+			SingleSelection: &tori.SingleSelection{
+				Label:      "Merkki",
+				ParamKey:   "cell_phone",
+				ValuesList: []tori.Value{{Label: "Apple", Value: "apple"}},
+			},
+		},
+		"delivery_options": {
+			MultiSelection: &tori.MultiSelection{
+				Label:      "Toimitus",
+				ParamKey:   "delivery_options",
+				ValuesList: []tori.Value{{Label: "Lähetys", Value: "delivery_send"}},
+			},
+		},
+	}
+	settingsParams := []tori.SettingsParam{
+		{
+			Keys: []string{"category"},
+			Settings: []tori.Settings{
+				{SettingsResult: []string{"general_condition", "cell_phone", "delivery_options"}, Values: []string{"5012"}},
+				{SettingsResult: []string{"general_condition", "delivery_options"}, Values: []string{"5031"}},
+				{SettingsResult: []string{"general_condition", "price", "delivery_options"}, Values: []string{"5013"}},
+				{SettingsResult: []string{"clothing_condition"}, Values: []string{"3050"}},
+			},
+		},
+	}
+	previous := tori.AdDetails{
+		"general_condition": "new",
+		"cell_phone":        "apple",
+		"delivery_options":  []string{},
+	}
+
+	tests := map[string]struct {
+		category string
+		previous tori.AdDetails
+		want     tori.AdDetails
+	}{
+		"keeps fields asked in new category": {
+			category: "5031",
+			previous: previous,
+			want: tori.AdDetails{
+				"general_condition": "new",
+				"delivery_options":  []string{},
+			},
+		},
+		"stops at first field without previous value": {
+			category: "5012",
+			previous: tori.AdDetails{"general_condition": "new", "delivery_options": []string{}},
+			want:     tori.AdDetails{"general_condition": "new"},
+		},
+		"restores fields asked after price": {
+			category: "5013",
+			previous: tori.AdDetails{"general_condition": "new", "delivery_options": []string{"delivery_send"}},
+			want: tori.AdDetails{
+				"general_condition": "new",
+				"delivery_options":  []string{"delivery_send"},
+			},
+		},
+		"stops at value not accepted in new category": {
+			category: "5012",
+			previous: tori.AdDetails{"general_condition": "new", "cell_phone": "nokia", "delivery_options": []string{}},
+			want:     tori.AdDetails{"general_condition": "new"},
+		},
+		"matches value by label": {
+			category: "3050",
+			previous: tori.AdDetails{"general_condition": "good"},
+			want:     tori.AdDetails{"general_condition": "2"},
+		},
+		"nothing to keep": {
+			category: "5012",
+			previous: nil,
+			want:     nil,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			listing := tori.Listing{
+				Subject:   "iPhone 12",
+				Body:      "Myydään käytetty iPhone 12",
+				Category:  tc.category,
+				Type:      tori.ListingTypeSell,
+				AdDetails: tc.previous,
+			}
+			assert.Equal(t, tc.want, restoreAdDetails(paramMap, settingsParams, listing, tc.previous))
+		})
+	}
+}
+
 func TestNewListingFromMessage(t *testing.T) {
 	tests := map[string]struct {
-		message string
-		want    tori.Listing
+		message     string
+		defaultType tori.ListingType
+		want        tori.Listing
 	}{
+		"defaults to given listing type": {
+			message:     "Horipad Logitech Switch peliohjain",
+			defaultType: tori.ListingTypeGive,
+			want: tori.Listing{
+				Subject: "Horipad Logitech Switch peliohjain",
+				Type:    tori.ListingTypeGive,
+			},
+		},
+		"prefix overrides default listing type": {
+			message:     "Myydään Horipad Logitech Switch peliohjain",
+			defaultType: tori.ListingTypeGive,
+			want: tori.Listing{
+				Subject: "Horipad Logitech Switch peliohjain",
+				Type:    tori.ListingTypeSell,
+			},
+		},
 		"defaults to sell listing type": {
-			message: "Horipad Logitech Switch peliohjain",
+			message:     "Horipad Logitech Switch peliohjain",
+			defaultType: tori.ListingTypeSell,
 			want: tori.Listing{
 				Subject: "Horipad Logitech Switch peliohjain",
 				Type:    tori.ListingTypeSell,
@@ -156,7 +320,7 @@ func TestNewListingFromMessage(t *testing.T) {
 	}
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
-			got := newListingFromMessage(tc.message)
+			got := newListingFromMessage(tc.message, tc.defaultType)
 			assert.Equal(t, tc.want, got)
 		})
 	}
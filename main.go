@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net/http"
 	"os"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -16,12 +17,12 @@ func main() {
 	zerolog.ErrorStackMarshaler = pkgerrors.MarshalStack
 
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
-	botToken, ok := os.LookupEnv("BOT_TOKEN")
-	if !ok {
-		log.Fatal().Msg("BOT_TOKEN is not set")
+	cfg, err := loadConfig(os.LookupEnv)
+	if err != nil {
+		log.Fatal().Err(err).Send()
 	}
 
-	tg, err := tgbotapi.NewBotAPI(botToken)
+	tg, err := tgbotapi.NewBotAPI(cfg.BotToken)
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to initialize telegram bot; bad token?")
 		os.Exit(1)
@@ -33,7 +34,7 @@ func main() {
 	updateConfig.Timeout = 60
 	updates := tg.GetUpdatesChan(updateConfig)
 
-	userConfigMap, err := readUserConfigMap()
+	userConfigMap, err := readUserConfigMap(cfg.UserConfigPath)
 	if err != nil {
 		log.Fatal().Err(err).Send()
 	}
@@ -41,6 +42,28 @@ func main() {
 	go keepSessionsAlive(tori.ApiBaseUrl, userConfigMap)
 
 	bot := NewBot(tg, userConfigMap, tori.ApiBaseUrl)
+	bot.sendRetryDelay = cfg.SendRetryDelay
+	bot.dryRun = cfg.DryRun
+	if cfg.ListingStoreDir != "" {
+		bot.listingStore, err = NewListingStore(cfg.ListingStoreDir)
+		if err != nil {
+			log.Fatal().Err(err).Send()
+		}
+	}
+
+	if cfg.HealthAddr != "" {
+		// Bot is ready when telegram API can be reached with the bot token
+		handler := newHealthHandler(func() error {
+			_, err := tg.GetMe()
+			return err
+		})
+		go func() {
+			log.Info().Str("addr", cfg.HealthAddr).Msg("serving health checks")
+			if err := http.ListenAndServe(cfg.HealthAddr, handler); err != nil {
+				log.Fatal().Err(err).Msg("health check server failed")
+			}
+		}()
+	}
 
 	for update := range updates {
 		go bot.handleUpdate(update)
@@ -18,22 +18,64 @@ const (
 	listingReadyCommands = `
 /laheta - Lähetä ilmoitus
 /peru - Peru ilmoituksen teko`
-	listingReadyToBeSentText         = `Ilmoitus on valmis lähetettäväksi.`
-	listingReadyToBeSentNoImagesText = `Ilmoitus on valmis lähetettäväksi, mutta *kuvat puuttuu*.`
-	cantFigureOutCategoryText        = "En keksinyt osastoa otsikon perusteella, eli pieleen meni."
-	incompleteListingOnSendText      = "Ilmoituksesta puuttuu kenttiä."
-	noListingOnSendText              = "Ei ole ilmoitusta mitä lähettää."
-	listingSentText                  = "Ilmoitus lähetetty!"
-	photosRemoved                    = "Kuvat poistettu."
-	invalidReplyToField              = `Vastauksesi ei sovi kenttään "%s". Valitse vastaus nappuloista viestikentän alapuolelta.`
-	unexpectedErrorText              = `Odottamaton virhe: %s`
-	okText                           = `Ok!`
-	startText                        = "Aloita ilmoituksen teko kirjoittamalla tavaran otsikko"
-	sessionMaybeExpiredText          = "Ilmoituksen tekoa ei voi aloittaa, koska tori-käyttäjäsi tiliä ei voitu hakea - sessio vanhentunut?"
-	noLocationsInToriAccountText     = "Tori-käyttäjäsi tiedoista puuttuu paikkakunta ja postinumero.\n\nAseta ne täällä: https://login.schibsted.fi/account/summary"
-	importJsonInputError             = "Komento toimii vain vastauksena JSON-arkistoon."
-	importJsonSuccessful             = "Ilmoitus tuotu arkistosta: %s"
-	forgetInvalidField               = "En osaa unohtaa pyydettyä kenttää. Vaihtoehdot: hinta"
+	listingReadyToBeSentText          = `Ilmoitus on valmis lähetettäväksi.`
+	listingReadyToBeSentNoImagesText  = `Ilmoitus on valmis lähetettäväksi, mutta *kuvat puuttuu*.`
+	cantFigureOutCategoryText         = "En keksinyt osastoa otsikon perusteella, eli pieleen meni."
+	incompleteListingOnSendText       = "Ilmoituksesta puuttuu kenttiä."
+	noListingOnSendText               = "Ei ole ilmoitusta mitä lähettää."
+	notEnoughPhotosOnSendText         = "Lähetä vielä %s ennen ilmoituksen lähettämistä."
+	tooManyPhotosText                 = "Osastoon voi lisätä enintään %s, joten ylimääräiset jätettiin pois."
+	photoUploadFailedText             = "%d/%d kuvaa ladattu, %d epäonnistui. Yritä uudelleen komennolla /laheta."
+	unknownCommandSuggestionText      = "Tarkoititko %s?"
+	settingsExportCaption             = "Asetukset voi palauttaa vastaamalla tähän viestiin komennolla /tuoasetukset"
+	importSettingsInputError          = "Komento toimii vain vastauksena asetustiedostoon."
+	importSettingsSuccessful          = "Asetukset tuotu."
+	importSettingsRejectedAliasesText = "Seuraavia aliaksia ei tuotu, koska niiden osastoon ei voi lisätä ilmoitusta: %s"
+	noListingOnCheckText              = "Ei ole ilmoitusta mitä tarkistaa."
+	listingChecksText                 = "*Tarkistus:*\n%s"
+	listingSentText                   = "Ilmoitus lähetetty!"
+	subjectTooLongText                = "Otsikko on liian pitkä (%d/%d merkkiä). Lyhennä otsikkoa muokkaamalla viestiä, jossa se on."
+	bodyTruncatedText                 = "Ilmoitusteksti lyhennettiin %d merkkiin, koska pidempää toriin ei voi lähettää."
+	listingDryRunText                 = "Kuivaharjoitus: ilmoitusta ei lähetetty. Ilmoituksen tiedot on kirjattu lokiin."
+	photosRemoved                     = "Kuvat poistettu."
+	noListingOnSwitchTypeText         = "Aloita ilmoituksen teko ennen ilmoituksen tyypin vaihtamista."
+	listingTypeSellText               = "*Ilmoituksen tyyppi:* Myydään"
+	listingTypeGiveText               = "*Ilmoituksen tyyppi:* Annetaan"
+	listingTypeNotSwitchableText      = "Vain myytävän tai annettavan ilmoituksen tyyppiä voi vaihtaa."
+	photosAddedWithDuplicatesText     = "%s lisätty. Ohitettu samoja kuvia: %d."
+	noPhotosText                      = "Ilmoituksessa ei ole kuvia."
+	photosText                        = "Kuvia: %d. Ensimmäinen kuva on ilmoituksen pääkuva."
+	photoNotFoundText                 = "Kuva on jo poistettu."
+	invalidReplyToField               = `Vastauksesi ei sovi kenttään "%s". Valitse vastaus nappuloista viestikentän alapuolelta.`
+	unexpectedErrorText               = `Odottamaton virhe: %s`
+	okText                            = `Ok!`
+	confirmCategoryText               = "Vahvista osasto tai valitse toinen napeista tai vastaamalla osaston numerolla."
+	confirmCategoryFirstText          = "Vahvista ensin osasto valitsemalla se osastoviestin napeista tai vastaamalla osaston numerolla."
+	changeCategoryText                = "Vaihda osastoa napeista tai vastaamalla tähän viestiin osaston numerolla."
+	invalidCategoryNumberText         = "Osastoa numerolla %s ei ole."
+	confirmCancelText                 = "Ilmoituksessa on %d kuvaa. Haluatko varmasti perua sen?"
+	confirmCancelReadyText            = "Ilmoitus on valmis lähetettäväksi. Haluatko varmasti perua sen?"
+	listingNotCancelledText           = "Ok, ilmoitusta ei peruttu."
+	listingCancelledText              = "Ok! Jos peruit vahingossa, saat ilmoituksen takaisin komennolla /perista parin minuutin ajan."
+	noCancelledListingText            = "Ei peruttua ilmoitusta, jonka voisi palauttaa."
+	listingInProgressOnRestoreText    = "Ilmoituksen teko on kesken. Peru se ensin komennolla /peru."
+	cancelledListingRestoredText      = "Ilmoitus palautettu: %s"
+	startText                         = "Aloita ilmoituksen teko kirjoittamalla tavaran otsikko"
+	sessionMaybeExpiredText           = "Ilmoituksen tekoa ei voi aloittaa, koska tori-käyttäjäsi tiliä ei voitu hakea - sessio vanhentunut?"
+	noLocationsInToriAccountText      = "Tori-käyttäjäsi tiedoista puuttuu paikkakunta ja postinumero.\n\nAseta ne täällä: https://login.schibsted.fi/account/summary"
+	importJsonInputError              = "Komento toimii vain vastauksena JSON-arkistoon."
+	importJsonSuccessful              = "Ilmoitus tuotu arkistosta: %s"
+	forgetInvalidField                = "En osaa unohtaa pyydettyä kenttää. Vaihtoehdot: hinta"
+	addCategoryAliasUsageText         = "Käyttö: /lisaa-alias <nimi> <osastokoodi>"
+	categoryAliasAddedText            = "Alias %s lisätty osastolle %s."
+	invalidCategoryAliasCodeText      = "Osastokoodilla %s ei löytynyt osastoa, johon voi lisätä ilmoituksen."
+	categoryCommandUsageText          = "Käyttö: /osasto <alias>, tai pelkkä /osasto selataksesi osastoja"
+	browseCategoriesText              = "Valitse osasto:"
+	searchCategoryUsageText           = "Käyttö: /etsiosasto <hakusanat>"
+	noCategoriesFoundText             = "Hakusanoilla %s ei löytynyt osastoja."
+	selectCategoryText                = "Valitse osasto:"
+	unknownCategoryAliasText          = "Tuntematon alias: %s"
+	noListingOnCategoryText           = "Aloita ilmoituksen teko ennen osaston valitsemista."
 )
 
 func makeCategoriesInlineKeyboard(categories []tori.Category) tgbotapi.InlineKeyboardMarkup {
@@ -62,15 +104,10 @@ func makeCategoriesInlineKeyboard(categories []tori.Category) tgbotapi.InlineKey
 }
 
 // makeCategoryMessage creates a telegram message with current category as
-// Text, and the other available categories as inline keyboard
+// Text, and the other available categories as inline keyboard. Categories are
+// numbered so that one can be selected without the inline keyboard, by
+// replying to the message with its number.
 func makeCategoryMessage(categories []tori.Category, categoryCode string) tgbotapi.MessageConfig {
-	var currentCategoryLabel string
-	for _, c := range categories {
-		if c.Code == categoryCode {
-			currentCategoryLabel = c.Label
-		}
-	}
-
 	var inlineKeyboardCategories []tori.Category
 	for _, c := range categories {
 		if c.Code != categoryCode {
@@ -78,16 +115,163 @@ func makeCategoryMessage(categories []tori.Category, categoryCode string) tgbota
 		}
 	}
 
-	msg := tgbotapi.NewMessage(0, fmt.Sprintf("*Osasto:* %s\n", currentCategoryLabel))
+	msg := tgbotapi.NewMessage(0, fmt.Sprintf("*Osasto:* %s\n", getCategoryLabel(categories, categoryCode)))
 	msg.ParseMode = tgbotapi.ModeMarkdown
 
 	if len(categories) > 1 {
+		msg.Text += "\n" + formatNumberedCategories(categories) + "\n" + changeCategoryText
 		msg.ReplyMarkup = makeCategoriesInlineKeyboard(inlineKeyboardCategories)
 	}
 
 	return msg
 }
 
+func getCategoryLabel(categories []tori.Category, categoryCode string) string {
+	for _, c := range categories {
+		if c.Code == categoryCode {
+			return c.Label
+		}
+	}
+	return ""
+}
+
+func formatNumberedCategories(categories []tori.Category) string {
+	var text string
+	for i, c := range categories {
+		text += fmt.Sprintf("%d. %s\n", i+1, c.Label)
+	}
+	return text
+}
+
+// makeCategoryConfirmMessage creates a telegram message that asks the user to
+// confirm the guessed category by selecting it, or any other category, from
+// the inline keyboard
+func makeCategoryConfirmMessage(categories []tori.Category, categoryCode string) tgbotapi.MessageConfig {
+	// Until the category is confirmed, any message with a number selects a
+	// category
+	msg := tgbotapi.NewMessage(0, fmt.Sprintf(
+		"*Osasto:* %s\n\n%s\n%s",
+		getCategoryLabel(categories, categoryCode),
+		formatNumberedCategories(categories),
+		confirmCategoryText,
+	))
+	msg.ParseMode = tgbotapi.ModeMarkdown
+	msg.ReplyMarkup = makeCategoriesInlineKeyboard(categories)
+	return msg
+}
+
+// browseCallbackPrefix is the prefix of callback data of buttons in the
+// message for browsing categories. It's followed by the code of the category
+// to open, or nothing for top level categories.
+const browseCallbackPrefix = "browse:"
+
+// makeCategoryBrowseMessage creates a telegram message with subcategories of
+// parent as inline keyboard, and a button to go back up a level. For top
+// level categories, parent is nil.
+func makeCategoryBrowseMessage(parent *tori.Category, categories []tori.Category, backCode string) tgbotapi.MessageConfig {
+	text := browseCategoriesText
+	if parent != nil {
+		text = fmt.Sprintf("*%s*\n%s", parent.Label, browseCategoriesText)
+	}
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i := 0; i < len(categories); i += 2 {
+		var row []tgbotapi.InlineKeyboardButton
+		for _, c := range categories[i:minInt(i+2, len(categories))] {
+			row = append(row, tgbotapi.NewInlineKeyboardButtonData(c.Label, browseCallbackPrefix+c.Code))
+		}
+		rows = append(rows, row)
+	}
+	if parent != nil {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("‹ Takaisin", browseCallbackPrefix+backCode),
+		))
+	}
+
+	msg := tgbotapi.NewMessage(0, text)
+	msg.ParseMode = tgbotapi.ModeMarkdown
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return msg
+}
+
+// categoryCallbackPrefix is the prefix of callback data of buttons in the
+// category search results message. It's followed by the code of the category
+// to select, because different categories can have the same label.
+const categoryCallbackPrefix = "category:"
+
+// makeCategorySearchResultsMessage creates a telegram message with found
+// categories as inline keyboard. Buttons show the parent category too, to tell
+// apart categories like "Muut" that are found under many parents.
+func makeCategorySearchResultsMessage(categories tori.Categories, results []tori.Category) tgbotapi.MessageConfig {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, c := range results {
+		text := c.Label
+		if parent, ok := categories.FindParent(c.Code); ok {
+			text = fmt.Sprintf("%s › %s", parent.Label, c.Label)
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(text, categoryCallbackPrefix+c.Code),
+		))
+	}
+
+	msg := tgbotapi.NewMessage(0, selectCategoryText)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return msg
+}
+
+// cancelCallbackPrefix is the prefix of callback data of buttons in the
+// message that confirms cancelling a listing
+const cancelCallbackPrefix = "cancel:"
+
+// makeConfirmCancelMessage creates a telegram message asking to confirm
+// cancelling the listing. The buttons have the listing's id, so that they
+// don't cancel another listing that was started later.
+func makeConfirmCancelMessage(text string, listingId string) tgbotapi.MessageConfig {
+	msg := tgbotapi.NewMessage(0, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Kyllä, peru", cancelCallbackPrefix+"yes:"+listingId),
+			tgbotapi.NewInlineKeyboardButtonData("Ei", cancelCallbackPrefix+"no:"+listingId),
+		),
+	)
+	return msg
+}
+
+// photosCallbackPrefix is the prefix of callback data of buttons in photos
+// message, that tells them apart from category buttons
+const photosCallbackPrefix = "photos:"
+
+// makePhotosMessage creates a telegram message with buttons to delete each
+// photo or make it the first one. Buttons refer to photos by their unique id
+// instead of position, so that a button in an older message can't change the
+// wrong photo.
+func makePhotosMessage(photos []tgbotapi.PhotoSize) tgbotapi.MessageConfig {
+	if len(photos) == 0 {
+		return tgbotapi.NewMessage(0, noPhotosText)
+	}
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, photo := range photos {
+		row := []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData(
+				fmt.Sprintf("Poista %d", i+1),
+				fmt.Sprintf("%sdelete:%s", photosCallbackPrefix, photo.FileUniqueID),
+			),
+		}
+		if i > 0 {
+			row = append(row, tgbotapi.NewInlineKeyboardButtonData(
+				fmt.Sprintf("Pääkuvaksi %d", i+1),
+				fmt.Sprintf("%scover:%s", photosCallbackPrefix, photo.FileUniqueID),
+			))
+		}
+		rows = append(rows, row)
+	}
+
+	msg := tgbotapi.NewMessage(0, fmt.Sprintf(photosText, len(photos)))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return msg
+}
+
 func valuesListToReplyKeyboard(valuesList []tori.Value) tgbotapi.ReplyKeyboardMarkup {
 	buttonsPerRow := 3
 
@@ -96,3 +96,28 @@ func TestMakeMissingFieldPromptMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestMakeCategoryConfirmMessage(t *testing.T) {
+	categories := []tori.Category{
+		{Code: "5012", Label: "Puhelimet"},
+		{Code: "5031", Label: "Tabletit"},
+	}
+	msg := makeCategoryConfirmMessage(categories, "5012")
+	assert.Equal(t, "*Osasto:* Puhelimet\n\n1. Puhelimet\n2. Tabletit\n\nVahvista osasto tai valitse toinen napeista tai vastaamalla osaston numerolla.", msg.Text)
+	assert.Equal(t, makeCategoriesInlineKeyboard(categories), msg.ReplyMarkup)
+}
+
+func TestMakeCategoryMessage(t *testing.T) {
+	categories := []tori.Category{
+		{Code: "5012", Label: "Puhelimet"},
+		{Code: "5031", Label: "Tabletit"},
+	}
+	msg := makeCategoryMessage(categories, "5012")
+	assert.Equal(t, "*Osasto:* Puhelimet\n\n1. Puhelimet\n2. Tabletit\n\nVaihda osastoa napeista tai vastaamalla tähän viestiin osaston numerolla.", msg.Text)
+	assert.Equal(t, makeCategoriesInlineKeyboard(categories[1:]), msg.ReplyMarkup)
+
+	// Nothing to change to
+	msg = makeCategoryMessage(categories[:1], "5012")
+	assert.Equal(t, "*Osasto:* Puhelimet\n", msg.Text)
+	assert.Nil(t, msg.ReplyMarkup)
+}
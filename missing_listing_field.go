@@ -49,6 +49,21 @@ func doesListingMatchAllValues(listing tori.Listing, keys []string, values []str
 	return true
 }
 
+// getParamKey returns the key of field's value in listing's AdDetails
+func getParamKey(paramMap tori.ParamMap, field string) string {
+	param := paramMap[field]
+	switch {
+	case param.SingleSelection != nil:
+		return param.SingleSelection.ParamKey
+	case param.MultiSelection != nil:
+		return param.MultiSelection.ParamKey
+	case param.Text != nil:
+		return param.Text.ParamKey
+	default:
+		return ""
+	}
+}
+
 func getMissingFieldFromSettingsResult(paramMap tori.ParamMap, listing tori.Listing, settingsResult []string) string {
 	for _, sr := range settingsResult {
 		// Type and zipcode are always set so skip them
@@ -65,19 +80,10 @@ func getMissingFieldFromSettingsResult(paramMap tori.ParamMap, listing tori.List
 			}
 		}
 
-		param, ok := paramMap[sr]
-		if !ok {
+		if _, ok := paramMap[sr]; !ok {
 			panic(fmt.Sprintf("%s not found in param_map (should not happen)", sr))
 		}
-		var paramKey string
-		switch {
-		case param.SingleSelection != nil:
-			paramKey = param.SingleSelection.ParamKey
-		case param.MultiSelection != nil:
-			paramKey = param.MultiSelection.ParamKey
-		case param.Text != nil:
-			paramKey = param.Text.ParamKey
-		}
+		paramKey := getParamKey(paramMap, sr)
 
 		// Otherwise, check if key is defined in listing.AdDetails
 		if _, ok := listing.AdDetails[paramKey]; !ok {
@@ -106,7 +112,12 @@ func getMissingListingField(paramMap tori.ParamMap, settingsParams []tori.Settin
 	if listing.Body == "" {
 		return "body"
 	}
+	return getMissingSettingsParamField(paramMap, settingsParams, listing)
+}
 
+// getMissingSettingsParamField returns the first missing field that tori's
+// settings_param list requires for the listing, leaving out the body
+func getMissingSettingsParamField(paramMap tori.ParamMap, settingsParams []tori.SettingsParam, listing tori.Listing) string {
 	for _, settingsParam := range settingsParams {
 		if next := getMissingListingFieldWithSettingsParam(paramMap, settingsParam, listing); next != "" {
 			return next
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/raine/telegram-tori-bot/tori"
+)
+
+// UserSettings are the settings user has made with bot commands. Settings
+// from user config, such as the tori token, are not included.
+type UserSettings struct {
+	CategoryAliases map[string]tori.Category `json:"categoryAliases"`
+}
+
+func (s *UserSession) exportSettings() UserSettings {
+	return UserSettings{
+		CategoryAliases: s.categoryAliases,
+	}
+}
+
+// importSettings merges the settings present in the imported file into the
+// current ones, so that settings missing from the file are left as they are.
+// Aliases are checked against categories the same way as in /lisaa-alias, and
+// the ones that don't point to a leaf category are returned instead of being
+// imported.
+func (s *UserSession) importSettings(settings UserSettings, categories tori.Categories) (rejectedAliases []string) {
+	for alias, imported := range settings.CategoryAliases {
+		category, ok := categories.FindCategory(imported.Code)
+		if !ok || !category.IsLeaf() {
+			rejectedAliases = append(rejectedAliases, alias)
+			continue
+		}
+		if s.categoryAliases == nil {
+			s.categoryAliases = make(map[string]tori.Category)
+		}
+		s.categoryAliases[strings.ToLower(alias)] = category
+	}
+	sort.Strings(rejectedAliases)
+	return rejectedAliases
+}
@@ -1,21 +1,50 @@
 package main
 
 import (
+	"net/http"
+	"time"
+
 	"github.com/go-resty/resty/v2"
 	"github.com/pkg/errors"
-	"github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
+)
+
+const (
+	downloadMaxRetries       = 2
+	downloadRetryWaitTime    = 100 * time.Millisecond
+	downloadRetryMaxWaitTime = time.Second
 )
 
+// shouldRetryDownload retries downloads that failed with a network error or
+// a server error. Resty does not retry network errors by itself when a retry
+// condition is set.
+func shouldRetryDownload(res *resty.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	if res == nil {
+		return false
+	}
+	code := res.StatusCode()
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
 func downloadFileID(
+	logger *zerolog.Logger,
 	getFileDirectURL func(fileId string) (string, error),
 	fileID string,
 ) ([]byte, error) {
-	log.Info().Interface("fileID", fileID).Msg("downloading file id")
+	logger.Info().Interface("fileID", fileID).Msg("downloading file id")
 	url, err := getFileDirectURL(fileID)
 	if err != nil {
 		return nil, err
 	}
-	client := resty.New().SetDebug(false)
+	client := resty.New().
+		SetDebug(false).
+		SetRetryCount(downloadMaxRetries).
+		SetRetryWaitTime(downloadRetryWaitTime).
+		SetRetryMaxWaitTime(downloadRetryMaxWaitTime).
+		AddRetryCondition(shouldRetryDownload)
 	res, err := client.R().Get(url)
 	if err != nil {
 		return nil, err
@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -34,7 +36,7 @@ func TestDownloadPhotoSize(t *testing.T) {
 		FileSize:     28548,
 	}
 
-	bytes, err := downloadFileID(getFileDirectUrl, photoSize.FileID)
+	bytes, err := downloadFileID(&log.Logger, getFileDirectUrl, photoSize.FileID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -42,3 +44,83 @@ func TestDownloadPhotoSize(t *testing.T) {
 	assert.Equal(t, []byte("123"), bytes)
 	assert.True(t, handlerCalled)
 }
+
+func TestDownloadPhotoSizeRetriesServerError(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("123"))
+	}))
+	defer ts.Close()
+
+	getFileDirectUrl := func(fileId string) (string, error) {
+		return fmt.Sprintf("%s/%s.jpeg", ts.URL, fileId), nil
+	}
+
+	bytes, err := downloadFileID(&log.Logger, getFileDirectUrl, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []byte("123"), bytes)
+	assert.Equal(t, 2, requests)
+}
+
+func TestDownloadPhotoSizeDoesNotRetryClientError(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	getFileDirectUrl := func(fileId string) (string, error) {
+		return fmt.Sprintf("%s/%s.jpeg", ts.URL, fileId), nil
+	}
+
+	_, err := downloadFileID(&log.Logger, getFileDirectUrl, "foo")
+	assert.Error(t, err)
+	assert.Equal(t, 1, requests)
+}
+
+// closeConnection drops the connection without responding, like a flaky
+// server could
+func closeConnection(t *testing.T, w http.ResponseWriter) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestDownloadPhotoSizeRetriesDroppedConnection(t *testing.T) {
+	// Counted atomically, since the client sees the dropped connection
+	// without synchronizing with the handler
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			closeConnection(t, w)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("123"))
+	}))
+	defer ts.Close()
+
+	getFileDirectUrl := func(fileId string) (string, error) {
+		return fmt.Sprintf("%s/%s.jpeg", ts.URL, fileId), nil
+	}
+
+	bytes, err := downloadFileID(&log.Logger, getFileDirectUrl, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []byte("123"), bytes)
+	assert.Equal(t, 2, int(atomic.LoadInt32(&requests)))
+}
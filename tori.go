@@ -99,6 +99,18 @@ func getCategoriesForSubject(client *tori.Client, subject string) ([]tori.Catego
 	return categories, nil
 }
 
+// defaultMaxImages is used when the category does not define how many images
+// a listing can have
+const defaultMaxImages = 10
+
+func getMaxImagesForCategory(categories tori.Categories, code string) int {
+	category, ok := categories.FindCategory(code)
+	if !ok || category.MaxImages <= 0 {
+		return defaultMaxImages
+	}
+	return category.MaxImages
+}
+
 func getLabelForField(
 	paramMap tori.ParamMap,
 	field string,
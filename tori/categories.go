@@ -39,6 +39,82 @@ func (c *Categories) GetCategoryLabel(code string) string {
 	return recur(0, c.Categories)
 }
 
+// FindCategory returns the category with the given code from anywhere in the
+// category tree
+func (c *Categories) FindCategory(code string) (Category, bool) {
+	var recur func(categories []Category) (Category, bool)
+	recur = func(categories []Category) (Category, bool) {
+		for _, c := range categories {
+			if c.Code == code {
+				return c, true
+			}
+			if found, ok := recur(c.Categories); ok {
+				return found, true
+			}
+		}
+		return Category{}, false
+	}
+
+	return recur(c.Categories)
+}
+
+// FindParent returns the category that has the category with the given code
+// as a direct subcategory. Top level categories have no parent.
+func (c *Categories) FindParent(code string) (Category, bool) {
+	var recur func(categories []Category) (Category, bool)
+	recur = func(categories []Category) (Category, bool) {
+		for _, c := range categories {
+			for _, sub := range c.Categories {
+				if sub.Code == code {
+					return c, true
+				}
+			}
+			if found, ok := recur(c.Categories); ok {
+				return found, true
+			}
+		}
+		return Category{}, false
+	}
+
+	return recur(c.Categories)
+}
+
+// SearchLeafCategories returns the categories without subcategories whose
+// label contains all of the space separated keywords, ignoring case
+func (c *Categories) SearchLeafCategories(keywords string) []Category {
+	words := strings.Fields(strings.ToLower(keywords))
+	var results []Category
+	var recur func(categories []Category)
+	recur = func(categories []Category) {
+		for _, c := range categories {
+			if !c.IsLeaf() {
+				recur(c.Categories)
+				continue
+			}
+			label := strings.ToLower(c.Label)
+			matches := len(words) > 0
+			for _, w := range words {
+				if !strings.Contains(label, w) {
+					matches = false
+					break
+				}
+			}
+			if matches {
+				results = append(results, c)
+			}
+		}
+	}
+
+	recur(c.Categories)
+	return results
+}
+
+// IsLeaf reports whether the category has no subcategories. Listings can
+// only be posted to leaf categories.
+func (c Category) IsLeaf() bool {
+	return len(c.Categories) == 0
+}
+
 func parseCategories(jsonData []byte) (Categories, error) {
 	var categories Categories
 	err := json.Unmarshal(jsonData, &categories)
@@ -22,3 +22,94 @@ func TestGetCategoryLabel(t *testing.T) {
 	assert.Equal(t, "Televisiot", categories.GetCategoryLabel("5022"))
 	assert.Equal(t, "", categories.GetCategoryLabel("132041980"))
 }
+
+func TestFindCategory(t *testing.T) {
+	categories := Categories{
+		Categories: []Category{
+			{
+				Code:  "5000",
+				Label: "ELEKTRONIIKKA",
+				Categories: []Category{
+					{
+						Code:  "5010",
+						Label: "Puhelimet ja tarvikkeet",
+						Categories: []Category{
+							{Code: "5012", Label: "Puhelimet"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	leaf, ok := categories.FindCategory("5012")
+	assert.True(t, ok)
+	assert.Equal(t, "Puhelimet", leaf.Label)
+	assert.True(t, leaf.IsLeaf())
+
+	parent, ok := categories.FindCategory("5010")
+	assert.True(t, ok)
+	assert.False(t, parent.IsLeaf())
+
+	_, ok = categories.FindCategory("9999")
+	assert.False(t, ok)
+}
+
+func TestSearchLeafCategories(t *testing.T) {
+	categories := Categories{
+		Categories: []Category{
+			{
+				Code:  "5000",
+				Label: "ELEKTRONIIKKA",
+				Categories: []Category{
+					{
+						Code:  "5010",
+						Label: "Puhelimet ja tarvikkeet",
+						Categories: []Category{
+							{Code: "5012", Label: "Puhelimet"},
+							{Code: "5013", Label: "Puhelinten tarvikkeet"},
+						},
+					},
+					{Code: "5031", Label: "Tabletit"},
+				},
+			},
+		},
+	}
+
+	assert.Equal(t, []Category{{Code: "5012", Label: "Puhelimet"}}, categories.SearchLeafCategories("PUHELIMET"))
+	assert.Equal(t, []Category{{Code: "5013", Label: "Puhelinten tarvikkeet"}}, categories.SearchLeafCategories("puhelin tarvik"))
+	assert.Len(t, categories.SearchLeafCategories("puhel"), 2)
+	assert.Empty(t, categories.SearchLeafCategories("elektroniikka"))
+	assert.Empty(t, categories.SearchLeafCategories(""))
+}
+
+func TestFindParent(t *testing.T) {
+	categories := Categories{
+		Categories: []Category{
+			{
+				Code:  "5000",
+				Label: "ELEKTRONIIKKA",
+				Categories: []Category{
+					{
+						Code:  "5010",
+						Label: "Puhelimet ja tarvikkeet",
+						Categories: []Category{
+							{Code: "5012", Label: "Puhelimet"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	parent, ok := categories.FindParent("5012")
+	assert.True(t, ok)
+	assert.Equal(t, "5010", parent.Code)
+
+	parent, ok = categories.FindParent("5010")
+	assert.True(t, ok)
+	assert.Equal(t, "5000", parent.Code)
+
+	_, ok = categories.FindParent("5000")
+	assert.False(t, ok)
+}
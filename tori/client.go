@@ -3,10 +3,13 @@ package tori
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/go-resty/resty/v2"
 	"github.com/pkg/errors"
-	"github.com/rs/zerolog/log"
+	"golang.org/x/exp/slices"
 )
 
 const (
@@ -29,9 +32,22 @@ type Account struct {
 	Locations []Location `json:"locations"`
 }
 
+const (
+	defaultMaxRetries       = 3
+	defaultRetryWaitTime    = 500 * time.Millisecond
+	defaultRetryMaxWaitTime = 5 * time.Second
+)
+
 type ClientOpts struct {
 	BaseURL string
 	Auth    string
+	// MaxRetries is how many times a GET request that failed with a
+	// transient error is retried. Defaults to 3, negative disables retrying.
+	MaxRetries int
+	// RetryWaitTime is the initial wait time between retries, which grows
+	// exponentially up to RetryMaxWaitTime
+	RetryWaitTime    time.Duration
+	RetryMaxWaitTime time.Duration
 }
 
 type Client struct {
@@ -48,6 +64,22 @@ func NewClient(opts ClientOpts) *Client {
 	if opts.Auth != "" {
 		c.auth = opts.Auth
 	}
+	maxRetries := defaultMaxRetries
+	if opts.MaxRetries != 0 {
+		maxRetries = opts.MaxRetries
+	}
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+	retryWaitTime := defaultRetryWaitTime
+	if opts.RetryWaitTime != 0 {
+		retryWaitTime = opts.RetryWaitTime
+	}
+	retryMaxWaitTime := defaultRetryMaxWaitTime
+	if opts.RetryMaxWaitTime != 0 {
+		retryMaxWaitTime = opts.RetryMaxWaitTime
+	}
+
 	c.httpClient = resty.New().
 		SetDebug(false).
 		SetBaseURL(c.baseURL).
@@ -56,14 +88,51 @@ func NewClient(opts ClientOpts) *Client {
 				"Accept":     "*/*",
 				"User-Agent": "Tori/190 CFNetwork/1329 Darwin/21.3.0",
 			},
-		)
+		).
+		// resty waits with exponential backoff and jitter between retries,
+		// unless the response has a Retry-After header
+		SetRetryCount(maxRetries).
+		SetRetryWaitTime(retryWaitTime).
+		SetRetryMaxWaitTime(retryMaxWaitTime).
+		SetRetryAfter(retryAfter).
+		AddRetryCondition(shouldRetry)
 
 	return &c
 }
 
+var retryableStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// shouldRetry retries only GET requests, because it can't be known whether a
+// failed POST, such as posting a listing, was already processed by tori. Resty
+// does not retry network errors by itself when a retry condition is set, so
+// they are retried here too.
+func shouldRetry(res *resty.Response, err error) bool {
+	if res == nil || res.Request == nil || res.Request.Method != http.MethodGet {
+		return false
+	}
+	return err != nil || slices.Contains(retryableStatusCodes, res.StatusCode())
+}
+
+// retryAfter returns the wait time in seconds from Retry-After header, or zero
+// to use the default backoff
+func retryAfter(_ *resty.Client, res *resty.Response) (time.Duration, error) {
+	seconds, err := strconv.Atoi(res.Header().Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0, nil
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
 func (c *Client) req(result any) *resty.Request {
+	// Base URL is set when creating the client, because the resty client is
+	// shared by concurrent requests, e.g. photo uploads
 	request := c.httpClient.
-		SetBaseURL(c.baseURL).
 		NewRequest().
 		SetHeader("Authorization", c.auth)
 
@@ -168,21 +237,35 @@ func (c *Client) PostListing(listing Listing) error {
 	return err
 }
 
+// ResponseError is returned for requests that got a failing response from
+// the API
+type ResponseError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	// Response is the body of the response, for logging
+	Response []byte
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("request failed: %s %s", e.Method, e.URL)
+}
+
 // handleError is a generic error handler for failing response (>399 status
-// code). Without this, failing responses would have nil error.
+// code). Without this, failing responses would have nil error. The error is
+// not logged here, but by the caller that knows which user and listing the
+// request was made for.
 func handleError(res *resty.Response, err error) (*resty.Response, error) {
 	if err != nil {
 		return res, err
 	}
 	if res.IsError() {
-		log.Error().
-			Str("url", res.Request.URL).
-			Str("method", res.Request.Method).
-			Int("status_code", res.StatusCode()).
-			Interface("request", res.Request.Body).
-			Bytes("response", res.Body()).
-			Send()
-		return res, errors.Errorf("request failed: %s %s", res.Request.Method, res.Request.URL)
+		return res, errors.WithStack(&ResponseError{
+			Method:     res.Request.Method,
+			URL:        res.Request.URL,
+			StatusCode: res.StatusCode(),
+			Response:   res.Body(),
+		})
 	}
 
 	return res, nil
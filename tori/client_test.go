@@ -5,7 +5,9 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -247,3 +249,130 @@ func TestPostListing(t *testing.T) {
 
 	assert.Equal(t, true, handlerCalled)
 }
+
+func TestHandleErrorReturnsResponseError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	client := NewClient(ClientOpts{BaseURL: ts.URL})
+	err := client.PostListing(Listing{Type: ListingTypeSell})
+
+	var responseError *ResponseError
+	assert.ErrorAs(t, err, &responseError)
+	assert.Equal(t, http.StatusServiceUnavailable, responseError.StatusCode)
+}
+
+func TestClientRetriesTransientErrors(t *testing.T) {
+	tests := map[string]struct {
+		method       string
+		statusCodes  []int
+		wantRequests int
+		wantErr      bool
+	}{
+		"GET succeeds after retries": {
+			method:       http.MethodGet,
+			statusCodes:  []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK},
+			wantRequests: 3,
+			wantErr:      false,
+		},
+		"GET gives up after max retries": {
+			method:       http.MethodGet,
+			statusCodes:  []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway},
+			wantRequests: 3,
+			wantErr:      true,
+		},
+		"GET is not retried on client error": {
+			method:       http.MethodGet,
+			statusCodes:  []int{http.StatusNotFound},
+			wantRequests: 1,
+			wantErr:      true,
+		},
+		"POST is not retried": {
+			method:       http.MethodPost,
+			statusCodes:  []int{http.StatusServiceUnavailable, http.StatusOK},
+			wantRequests: 1,
+			wantErr:      true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			requests := 0
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tc.statusCodes[requests])
+				requests++
+				w.Write([]byte("{}"))
+			}))
+			defer ts.Close()
+
+			client := NewClient(ClientOpts{
+				BaseURL:          ts.URL,
+				MaxRetries:       2,
+				RetryWaitTime:    time.Millisecond,
+				RetryMaxWaitTime: time.Millisecond,
+			})
+
+			var err error
+			if tc.method == http.MethodGet {
+				_, err = client.GetAccount("123123")
+			} else {
+				err = client.PostListing(Listing{Type: ListingTypeSell})
+			}
+
+			assert.Equal(t, tc.wantRequests, requests)
+			assert.Equal(t, tc.wantErr, err != nil)
+		})
+	}
+}
+
+func TestClientRetriesDroppedConnection(t *testing.T) {
+	tests := map[string]struct {
+		method       string
+		wantRequests int
+		wantErr      bool
+	}{
+		"GET is retried":      {method: http.MethodGet, wantRequests: 2, wantErr: false},
+		"POST is not retried": {method: http.MethodPost, wantRequests: 1, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			// Counted atomically, since the client sees the dropped connection
+			// without synchronizing with the handler
+			var requests int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&requests, 1) == 1 {
+					conn, _, err := w.(http.Hijacker).Hijack()
+					if err != nil {
+						t.Fatal(err)
+					}
+					conn.Close()
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte("{}"))
+			}))
+			defer ts.Close()
+
+			client := NewClient(ClientOpts{
+				BaseURL:          ts.URL,
+				MaxRetries:       2,
+				RetryWaitTime:    time.Millisecond,
+				RetryMaxWaitTime: time.Millisecond,
+			})
+
+			var err error
+			if tc.method == http.MethodGet {
+				_, err = client.GetAccount("123123")
+			} else {
+				err = client.PostListing(Listing{Type: ListingTypeSell})
+			}
+
+			assert.Equal(t, tc.wantRequests, int(atomic.LoadInt32(&requests)))
+			assert.Equal(t, tc.wantErr, err != nil)
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package tori
+
+import (
+	"strings"
+	"unicode"
+)
+
+const minDescriptionLength = 30
+
+func normalizeText(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}), " ")
+}
+
+// AssessDescriptionQuality checks that the listing description is not too
+// thin to be useful for buyers. The hint suggests how to improve the
+// description when it is not ok.
+func AssessDescriptionQuality(title string, description string) (ok bool, hint string) {
+	normalizedDescription := normalizeText(description)
+
+	if normalizedDescription == normalizeText(title) {
+		return false, "Ilmoitusteksti on sama kuin otsikko. Kerro tuotteesta jotain, mitä otsikossa ei ole."
+	}
+
+	if len([]rune(normalizedDescription)) < minDescriptionLength {
+		return false, "Ilmoitusteksti on lyhyt. Kerro esimerkiksi tuotteen kunnosta, koosta tai iästä."
+	}
+
+	return true, ""
+}
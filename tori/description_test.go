@@ -0,0 +1,39 @@
+package tori
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssessDescriptionQuality(t *testing.T) {
+	tests := map[string]struct {
+		title       string
+		description string
+		wantOk      bool
+	}{
+		"one word": {
+			title:       "iPhone 12",
+			description: "Toimii",
+			wantOk:      false,
+		},
+		"same as title": {
+			title:       "iPhone 12 Pro Max 256GB, sininen",
+			description: "iphone 12 pro max 256gb sininen!",
+			wantOk:      false,
+		},
+		"detailed": {
+			title:       "iPhone 12",
+			description: "Käytetty iPhone 12, akun kunto 89%. Näytössä pieni naarmu, muuten hyvä.",
+			wantOk:      true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ok, hint := AssessDescriptionQuality(tc.title, tc.description)
+			assert.Equal(t, tc.wantOk, ok)
+			assert.Equal(t, tc.wantOk, hint == "")
+		})
+	}
+}
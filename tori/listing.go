@@ -63,6 +63,13 @@ type (
 	MultiValue  []string
 )
 
+// Maximum lengths of subject and body in characters. Longer listings are
+// rejected by tori.
+const (
+	MaxSubjectLength = 50
+	MaxBodyLength    = 5000
+)
+
 type ListingLocation struct {
 	Region  string `json:"region"`
 	Zipcode string `json:"zipcode"`
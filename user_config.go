@@ -2,7 +2,6 @@ package main
 
 import (
 	"io/ioutil"
-	"os"
 
 	"github.com/pelletier/go-toml/v2"
 	"github.com/pkg/errors"
@@ -13,6 +12,24 @@ type (
 		TelegramUserId int64
 		Token          string
 		ToriAccountId  string
+		// MinPhotos is the number of photos a listing needs to have before it
+		// can be sent
+		MinPhotos int
+		// ShowPhone makes the phone number of the tori account visible in
+		// listings. Buyers can only contact via tori chat otherwise.
+		ShowPhone bool
+		// DescriptionQualityCheck enables hints about listing descriptions that
+		// are too short or repeat the subject
+		DescriptionQualityCheck bool
+		// ConfirmCategory requires the user to confirm the category guessed
+		// from subject before other fields are asked
+		ConfirmCategory bool
+		// GiveByDefault makes new listings give away listings, unless subject
+		// is prefixed with "myydään"
+		GiveByDefault bool
+		// CommandAliases maps other names to commands, e.g. "/l" to "/laheta".
+		// When set, they are used instead of the default aliases.
+		CommandAliases map[string]string
 	}
 	UserConfig struct {
 		Users []UserConfigItem
@@ -20,12 +37,7 @@ type (
 	UserConfigMap map[int64]UserConfigItem
 )
 
-func readUserConfigMap() (UserConfigMap, error) {
-	userConfigPath, ok := os.LookupEnv("USER_CONFIG_PATH")
-	if !ok {
-		return nil, errors.Errorf("USER_CONFIG_PATH env var not defined")
-	}
-
+func readUserConfigMap(userConfigPath string) (UserConfigMap, error) {
 	bytes, err := ioutil.ReadFile(userConfigPath)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not read auth config")
@@ -40,6 +52,13 @@ func readUserConfigMap() (UserConfigMap, error) {
 	userConfigMap := make(UserConfigMap)
 
 	for _, configUser := range userConfig.Users {
+		if configUser.CommandAliases != nil {
+			aliases, err := normalizeCommandAliases(configUser.CommandAliases)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid config for user %d", configUser.TelegramUserId)
+			}
+			configUser.CommandAliases = aliases
+		}
 		userConfigMap[configUser.TelegramUserId] = configUser
 	}
 
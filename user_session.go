@@ -1,10 +1,14 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"sync"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
 	"github.com/raine/telegram-tori-bot/tori"
@@ -16,32 +20,192 @@ type PendingPhoto struct {
 }
 
 type UserSession struct {
-	userId               int64
-	client               *tori.Client
-	listing              *tori.Listing
-	toriAccountId        string
-	bot                  *Bot
-	mu                   sync.Mutex
-	pendingPhotos        *[]PendingPhoto
-	photos               []tgbotapi.PhotoSize
-	categories           []tori.Category
-	userSubjectMessageId int
-	userBodyMessageId    int
-	botSubjectMessageId  int
-	botBodyMessageId     int
+	userId                  int64
+	client                  *tori.Client
+	listing                 *tori.Listing
+	toriAccountId           string
+	minPhotos               int
+	showPhone               bool
+	descriptionQualityCheck bool
+	confirmCategory         bool
+	giveByDefault           bool
+	commandAliases          map[string]string
+	categoryUnconfirmed     bool
+	bot                     *Bot
+	mu                      sync.Mutex
+	pendingPhotos           *[]PendingPhoto
+	photos                  []tgbotapi.PhotoSize
+	categories              []tori.Category
+	userSubjectMessageId    int
+	userBodyMessageId       int
+	botSubjectMessageId     int
+	botBodyMessageId        int
+	botCategoryMessageId    int
+	// photoHashes are hashes of photos' contents by FileUniqueID, used to
+	// notice the same photo being added again
+	photoHashes map[string]string
+	// categoryAliases are user defined shortcuts to categories, set with
+	// /lisaa-alias. They are kept over session resets.
+	categoryAliases map[string]tori.Category
+	// listingId identifies the listing being created in logs, so that
+	// everything that happened to one listing can be found
+	listingId string
+	// cancelledListing is the listing that was cancelled with /peru, kept for
+	// a while so that it can be restored with /perista
+	cancelledListing *cancelledListing
+}
+
+type cancelledListing struct {
+	saved       SavedListing
+	cancelledAt time.Time
+}
+
+// restoreCancelledListingWindow is how long a cancelled listing can be
+// restored
+const restoreCancelledListingWindow = 2 * time.Minute
+
+// cancelListing resets the session, keeping the listing in progress so that
+// it can be restored. Reports whether there was a listing to cancel.
+func (s *UserSession) cancelListing() bool {
+	if s.listing == nil {
+		s.reset()
+		return false
+	}
+
+	s.cancelledListing = &cancelledListing{
+		saved:       s.savedListing(),
+		cancelledAt: time.Now(),
+	}
+	s.reset()
+	return true
+}
+
+// restoreCancelledListing restores the listing cancelled with /peru, if it
+// was cancelled recently enough
+func (s *UserSession) restoreCancelledListing() bool {
+	cancelled := s.cancelledListing
+	s.cancelledListing = nil
+	if cancelled == nil || time.Since(cancelled.cancelledAt) > restoreCancelledListingWindow {
+		return false
+	}
+
+	s.restoreListing(cancelled.saved)
+	return true
+}
+
+// defaultListingType is the type of new listings whose subject doesn't say
+// whether the item is sold or given away
+func (s *UserSession) defaultListingType() tori.ListingType {
+	if s.giveByDefault {
+		return tori.ListingTypeGive
+	}
+	return tori.ListingTypeSell
+}
+
+// startListing sets the listing being created in the session
+func (s *UserSession) startListing(listing *tori.Listing) {
+	s.listing = listing
+	s.listingId = newListingId()
+}
+
+// logger returns a logger with the user and the listing in progress as fields
+func (s *UserSession) logger() *zerolog.Logger {
+	ctx := log.With().Int64("userId", s.userId)
+	if s.listingId != "" {
+		ctx = ctx.Str("listingId", s.listingId)
+	}
+	logger := ctx.Logger()
+	return &logger
+}
+
+// withResponseError adds the details of a failed request to tori API to the
+// log event, if err is from one
+func withResponseError(event *zerolog.Event, err error) *zerolog.Event {
+	var responseError *tori.ResponseError
+	if errors.As(err, &responseError) {
+		event = event.
+			Str("url", responseError.URL).
+			Str("method", responseError.Method).
+			Int("statusCode", responseError.StatusCode).
+			Bytes("response", responseError.Response)
+	}
+	return event
+}
+
+// saveListing saves the listing in progress to the listing store, or removes
+// the saved listing if there is no listing in progress
+func (s *UserSession) saveListing() {
+	store := s.bot.listingStore
+	if store == nil {
+		return
+	}
+
+	var err error
+	if s.listing == nil {
+		err = store.Delete(s.userId)
+	} else {
+		err = store.Save(s.userId, s.savedListing())
+	}
+	if err != nil {
+		s.logger().Error().Err(err).Msg("failed to save listing")
+	}
+}
+
+// savedListing returns the listing in progress with the state needed to
+// continue creating it later
+func (s *UserSession) savedListing() SavedListing {
+	return SavedListing{
+		ListingId:            s.listingId,
+		Listing:              *s.listing,
+		Photos:               s.photos,
+		Categories:           s.categories,
+		UserSubjectMessageId: s.userSubjectMessageId,
+		UserBodyMessageId:    s.userBodyMessageId,
+		BotSubjectMessageId:  s.botSubjectMessageId,
+		BotBodyMessageId:     s.botBodyMessageId,
+		BotCategoryMessageId: s.botCategoryMessageId,
+		CategoryUnconfirmed:  s.categoryUnconfirmed,
+	}
+}
+
+// restoreListing continues a listing that was saved earlier
+func (s *UserSession) restoreListing(saved SavedListing) {
+	s.listing = &saved.Listing
+	s.listingId = saved.ListingId
+	s.photos = saved.Photos
+	s.categories = saved.Categories
+	s.userSubjectMessageId = saved.UserSubjectMessageId
+	s.userBodyMessageId = saved.UserBodyMessageId
+	s.botSubjectMessageId = saved.BotSubjectMessageId
+	s.botBodyMessageId = saved.BotBodyMessageId
+	s.botCategoryMessageId = saved.BotCategoryMessageId
+	s.categoryUnconfirmed = saved.CategoryUnconfirmed
+	s.logger().Info().Msg("restored saved listing")
+}
+
+func newListingId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
 }
 
 func (s *UserSession) reset() {
-	log.Info().Int64("userId", s.userId).Msg("reset user session")
+	s.logger().Info().Msg("reset user session")
 	s.listing = nil
 	s.pendingPhotos = nil
 	s.photos = nil
+	s.photoHashes = nil
 	s.categories = nil
 	s.userSubjectMessageId = 0
+	s.botCategoryMessageId = 0
+	s.listingId = ""
+	s.categoryUnconfirmed = false
 }
 
 func (s *UserSession) replyWithError(err error) tgbotapi.Message {
-	log.Error().Stack().Err(errors.WithStack(err)).Send()
+	withResponseError(s.logger().Error(), err).Stack().Err(errors.WithStack(err)).Send()
 	return s._reply(formatReplyText(unexpectedErrorText, err), false)
 }
 
@@ -49,11 +213,11 @@ func (s *UserSession) replyWithMessage(msg tgbotapi.MessageConfig) tgbotapi.Mess
 	msg.ChatID = s.userId
 	sent, err := s.bot.tg.Send(msg)
 	if err != nil {
-		log.Error().Stack().
+		s.logger().Error().Stack().
 			Interface("msg", msg).
 			Err(errors.Wrap(err, "failed to send reply message")).Send()
 	} else {
-		log.Info().Interface("msg", msg).Interface("sent", sent).Msg("sent message")
+		s.logger().Info().Interface("msg", msg).Interface("sent", sent).Msg("sent message")
 	}
 
 	return sent
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/raine/telegram-tori-bot/tori"
+)
+
+type listingCheck struct {
+	label string
+	ok    bool
+	// warning marks a check that doesn't prevent sending, but where the
+	// listing will be changed when it's sent
+	warning bool
+}
+
+// fieldLabels are labels of fields that are not in tori's param map
+var fieldLabels = map[string]string{
+	"price": "Hinta",
+}
+
+// validateListing runs the checks that can be made for a listing without
+// sending it to tori, mirroring what /laheta does. Only the first missing
+// field is reported, because the fields that are required can depend on the
+// values of previous fields.
+func validateListing(
+	paramMap tori.ParamMap,
+	settingsParams []tori.SettingsParam,
+	categories tori.Categories,
+	listing tori.Listing,
+	categoryUnconfirmed bool,
+	photoCount int,
+	minPhotos int,
+) []listingCheck {
+	subjectCheck := listingCheck{label: "Otsikko", ok: strings.TrimSpace(listing.Subject) != ""}
+	if n := utf8.RuneCountInString(listing.Subject); n > tori.MaxSubjectLength {
+		subjectCheck = listingCheck{
+			label: fmt.Sprintf("Otsikko: liian pitkä (%d/%d merkkiä)", n, tori.MaxSubjectLength),
+			ok:    false,
+		}
+	}
+	bodyCheck := listingCheck{label: "Ilmoitusteksti", ok: strings.TrimSpace(listing.Body) != ""}
+	// Too long body is truncated when sending, so it's only a warning
+	if n := utf8.RuneCountInString(listing.Body); n > tori.MaxBodyLength {
+		bodyCheck = listingCheck{
+			label:   fmt.Sprintf("Ilmoitusteksti: lyhennetään %d merkkiin (%d merkkiä)", tori.MaxBodyLength, n),
+			ok:      true,
+			warning: true,
+		}
+	}
+	// Listings can only be posted to leaf categories
+	category, ok := categories.FindCategory(listing.Category)
+	categoryCheck := listingCheck{label: "Osasto", ok: ok && category.IsLeaf()}
+	if categoryUnconfirmed {
+		categoryCheck = listingCheck{label: "Osasto: vahvistamatta", ok: false}
+	}
+	checks := []listingCheck{
+		subjectCheck,
+		bodyCheck,
+		categoryCheck,
+	}
+
+	// Body has its own check above
+	if missingField := getMissingSettingsParamField(paramMap, settingsParams, listing); missingField == "" {
+		checks = append(checks, listingCheck{label: "Kentät", ok: true})
+	} else {
+		label, err := getLabelForField(paramMap, missingField)
+		if err != nil {
+			label = fieldLabels[missingField]
+		}
+		if label == "" {
+			label = missingField
+		}
+		checks = append(checks, listingCheck{label: fmt.Sprintf("Kentät: %s puuttuu", label), ok: false})
+	}
+
+	photosLabel := fmt.Sprintf("Kuvat (%d)", photoCount)
+	if minPhotos > 0 {
+		photosLabel = fmt.Sprintf("Kuvat (%d/%d)", photoCount, minPhotos)
+	}
+	checks = append(checks, listingCheck{
+		label: photosLabel,
+		ok:    photoCount >= minPhotos,
+	})
+
+	return checks
+}
+
+// truncateAtWordBoundary shortens s to at most max characters, cutting at
+// the last whitespace before the limit if there is one
+func truncateAtWordBoundary(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	truncated := string(runes[:max])
+	if i := strings.LastIndexFunc(truncated, unicode.IsSpace); i > 0 {
+		truncated = truncated[:i]
+	}
+	return strings.TrimRightFunc(truncated, unicode.IsSpace)
+}
+
+func formatListingChecks(checks []listingCheck) string {
+	lines := make([]string, 0, len(checks))
+	for _, c := range checks {
+		mark := "✅"
+		if !c.ok {
+			mark = "❌"
+		} else if c.warning {
+			mark = "⚠️"
+		}
+		lines = append(lines, fmt.Sprintf("%s %s", mark, c.label))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func allListingChecksOk(checks []listingCheck) bool {
+	for _, c := range checks {
+		if !c.ok {
+			return false
+		}
+	}
+	return true
+}
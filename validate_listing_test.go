@@ -0,0 +1,251 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/raine/telegram-tori-bot/tori"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateListing(t *testing.T) {
+	paramMap := tori.ParamMap{
+		"general_condition": {
+			SingleSelection: &tori.SingleSelection{Label: "Kunto", ParamKey: "general_condition"},
+		},
+	}
+	settingsParams := []tori.SettingsParam{
+		{
+			Keys: []string{"category", "type"},
+			Settings: []tori.Settings{
+				{
+					SettingsResult: []string{"type_skg", "general_condition", "zipcode", "price"},
+					Values:         []string{"5012", "s"},
+				},
+			},
+		},
+	}
+
+	categories := tori.Categories{
+		Categories: []tori.Category{
+			{
+				Code:  "5010",
+				Label: "Puhelimet ja tarvikkeet",
+				Categories: []tori.Category{
+					{Code: "5012", Label: "Puhelimet"},
+				},
+			},
+		},
+	}
+
+	tests := map[string]struct {
+		listing             tori.Listing
+		categoryUnconfirmed bool
+		photoCount          int
+		minPhotos           int
+		want                []listingCheck
+	}{
+		"missing required field": {
+			listing: tori.Listing{
+				Subject:  "iPhone 12",
+				Body:     "Myydään käytetty iPhone 12",
+				Category: "5012",
+				Type:     tori.ListingTypeSell,
+				Price:    50,
+			},
+			photoCount: 1,
+			want: []listingCheck{
+				{label: "Otsikko", ok: true},
+				{label: "Ilmoitusteksti", ok: true},
+				{label: "Osasto", ok: true},
+				{label: "Kentät: Kunto puuttuu", ok: false},
+				{label: "Kuvat (1)", ok: true},
+			},
+		},
+		"too few photos": {
+			listing: tori.Listing{
+				Subject:   "iPhone 12",
+				Body:      "Myydään käytetty iPhone 12",
+				Category:  "5012",
+				Type:      tori.ListingTypeSell,
+				Price:     50,
+				AdDetails: tori.AdDetails{"general_condition": "new"},
+			},
+			photoCount: 1,
+			minPhotos:  2,
+			want: []listingCheck{
+				{label: "Otsikko", ok: true},
+				{label: "Ilmoitusteksti", ok: true},
+				{label: "Osasto", ok: true},
+				{label: "Kentät", ok: true},
+				{label: "Kuvat (1/2)", ok: false},
+			},
+		},
+		"too long subject": {
+			listing: tori.Listing{
+				Subject:   "Apple iPhone 12 128GB musta, hyvässä kunnossa, laturi ja kuoret mukana",
+				Body:      "Myydään käytetty iPhone 12",
+				Category:  "5012",
+				Type:      tori.ListingTypeSell,
+				Price:     50,
+				AdDetails: tori.AdDetails{"general_condition": "new"},
+			},
+			photoCount: 1,
+			want: []listingCheck{
+				{label: "Otsikko: liian pitkä (70/50 merkkiä)", ok: false},
+				{label: "Ilmoitusteksti", ok: true},
+				{label: "Osasto", ok: true},
+				{label: "Kentät", ok: true},
+				{label: "Kuvat (1)", ok: true},
+			},
+		},
+		"too long body": {
+			listing: tori.Listing{
+				Subject:   "iPhone 12",
+				Body:      strings.Repeat("a", tori.MaxBodyLength+1),
+				Category:  "5012",
+				Type:      tori.ListingTypeSell,
+				Price:     50,
+				AdDetails: tori.AdDetails{"general_condition": "new"},
+			},
+			photoCount: 1,
+			want: []listingCheck{
+				{label: "Otsikko", ok: true},
+				{label: "Ilmoitusteksti: lyhennetään 5000 merkkiin (5001 merkkiä)", ok: true, warning: true},
+				{label: "Osasto", ok: true},
+				{label: "Kentät", ok: true},
+				{label: "Kuvat (1)", ok: true},
+			},
+		},
+		"category that is not a leaf": {
+			listing: tori.Listing{
+				Subject:   "iPhone 12",
+				Body:      "Myydään käytetty iPhone 12",
+				Category:  "5010",
+				Type:      tori.ListingTypeSell,
+				Price:     50,
+				AdDetails: tori.AdDetails{"general_condition": "new"},
+			},
+			photoCount: 1,
+			want: []listingCheck{
+				{label: "Otsikko", ok: true},
+				{label: "Ilmoitusteksti", ok: true},
+				{label: "Osasto", ok: false},
+				{label: "Kentät", ok: true},
+				{label: "Kuvat (1)", ok: true},
+			},
+		},
+		"missing price": {
+			listing: tori.Listing{
+				Subject:   "iPhone 12",
+				Body:      "Myydään käytetty iPhone 12",
+				Category:  "5012",
+				Type:      tori.ListingTypeSell,
+				AdDetails: tori.AdDetails{"general_condition": "new"},
+			},
+			photoCount: 1,
+			want: []listingCheck{
+				{label: "Otsikko", ok: true},
+				{label: "Ilmoitusteksti", ok: true},
+				{label: "Osasto", ok: true},
+				{label: "Kentät: Hinta puuttuu", ok: false},
+				{label: "Kuvat (1)", ok: true},
+			},
+		},
+		"unconfirmed category": {
+			listing: tori.Listing{
+				Subject:   "iPhone 12",
+				Body:      "Myydään käytetty iPhone 12",
+				Category:  "5012",
+				Type:      tori.ListingTypeSell,
+				Price:     50,
+				AdDetails: tori.AdDetails{"general_condition": "new"},
+			},
+			categoryUnconfirmed: true,
+			photoCount:          1,
+			want: []listingCheck{
+				{label: "Otsikko", ok: true},
+				{label: "Ilmoitusteksti", ok: true},
+				{label: "Osasto: vahvistamatta", ok: false},
+				{label: "Kentät", ok: true},
+				{label: "Kuvat (1)", ok: true},
+			},
+		},
+		"missing body": {
+			listing: tori.Listing{
+				Subject:  "iPhone 12",
+				Category: "5012",
+				Type:     tori.ListingTypeSell,
+				Price:    50,
+			},
+			photoCount: 1,
+			want: []listingCheck{
+				{label: "Otsikko", ok: true},
+				{label: "Ilmoitusteksti", ok: false},
+				{label: "Osasto", ok: true},
+				{label: "Kentät: Kunto puuttuu", ok: false},
+				{label: "Kuvat (1)", ok: true},
+			},
+		},
+		"no photos required": {
+			listing: tori.Listing{
+				Subject:   "iPhone 12",
+				Body:      "Myydään käytetty iPhone 12",
+				Category:  "5012",
+				Type:      tori.ListingTypeSell,
+				Price:     50,
+				AdDetails: tori.AdDetails{"general_condition": "new"},
+			},
+			want: []listingCheck{
+				{label: "Otsikko", ok: true},
+				{label: "Ilmoitusteksti", ok: true},
+				{label: "Osasto", ok: true},
+				{label: "Kentät", ok: true},
+				{label: "Kuvat (0)", ok: true},
+			},
+		},
+		"complete listing": {
+			listing: tori.Listing{
+				Subject:   "iPhone 12",
+				Body:      "Myydään käytetty iPhone 12",
+				Category:  "5012",
+				Type:      tori.ListingTypeSell,
+				Price:     50,
+				AdDetails: tori.AdDetails{"general_condition": "new"},
+			},
+			photoCount: 2,
+			want: []listingCheck{
+				{label: "Otsikko", ok: true},
+				{label: "Ilmoitusteksti", ok: true},
+				{label: "Osasto", ok: true},
+				{label: "Kentät", ok: true},
+				{label: "Kuvat (2)", ok: true},
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := validateListing(paramMap, settingsParams, categories, tc.listing, tc.categoryUnconfirmed, tc.photoCount, tc.minPhotos)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestTruncateAtWordBoundary(t *testing.T) {
+	assert.Equal(t, "lyhyt teksti", truncateAtWordBoundary("lyhyt teksti", 20))
+	assert.Equal(t, "käytetty", truncateAtWordBoundary("käytetty iPhone", 12))
+	assert.Equal(t, "käyte", truncateAtWordBoundary("käytetty", 5))
+}
+
+func TestFormatListingChecks(t *testing.T) {
+	checks := []listingCheck{
+		{label: "Otsikko", ok: true},
+		{label: "Ilmoitusteksti: lyhennetään", ok: true, warning: true},
+		{label: "Kuvat (0/1)", ok: false},
+	}
+
+	assert.Equal(t, "✅ Otsikko\n⚠️ Ilmoitusteksti: lyhennetään\n❌ Kuvat (0/1)", formatListingChecks(checks))
+	assert.False(t, allListingChecksOk(checks))
+	assert.True(t, allListingChecksOk(checks[:2]))
+}